@@ -3,8 +3,13 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func parseAdmContextRequest(r *http.Request) (string, error) {
@@ -67,13 +72,229 @@ func parseAdmTokenRequest(r *http.Request) (string, error) {
 	return "", errors.New("JSON body must have 1 key-value pair")
 }
 
-func parseAdmTokenGrantRequest(r *http.Request) (string, string, string, error) {
-	body, err := io.ReadAll(r.Body)
+// parseAdmTokenPostRequest reads the optional metadata of a new token: a name, free-form labels
+// and either a lifetime in seconds ("ttl") or an RFC 3339 expiry time ("expires_at").
+// Unknown fields are ignored and the body may be empty.
+func parseAdmTokenPostRequest(r *http.Request) (tokenInfo, error) {
+	defer r.Body.Close()
+
+	var data struct {
+		Name      string            `json:"name"`
+		Labels    map[string]string `json:"labels"`
+		TTL       *int64            `json:"ttl"`
+		ExpiresAt *string           `json:"expires_at"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return tokenInfo{}, err
+	}
+
+	expiresAt, err := parseExpiry(data.TTL, data.ExpiresAt)
+	if err != nil {
+		return tokenInfo{}, err
+	}
+	info := newTokenInfo(data.Name, data.Labels, expiresAt)
+	// A lifetime counts from the creation time, so the token lives exactly ttl seconds.
+	if data.TTL != nil {
+		info.ExpiresAt = info.CreatedAt + *data.TTL*time.Second.Milliseconds()
+	}
+	return info, nil
+}
+
+// parseAdmTokenRotateRequest reads the token to rotate, either by its secret ("token") or by its ID ("id"),
+// and how many minutes the old secret stays valid ("grace_minutes", 0 by default).
+func parseAdmTokenRotateRequest(r *http.Request) (string, string, time.Duration, error) {
+	defer r.Body.Close()
+
+	var data struct {
+		Token        string `json:"token"`
+		ID           string `json:"id"`
+		GraceMinutes int64  `json:"grace_minutes"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	if (data.Token == "") == (data.ID == "") {
+		return "", "", 0, errors.New("exactly one of token and id must be defined")
+	}
+	if data.GraceMinutes < 0 {
+		return "", "", 0, errors.New("grace_minutes can't be negative")
+	}
+	return data.Token, data.ID, time.Duration(data.GraceMinutes) * time.Minute, nil
+}
+
+// resolveTokenID returns the ID of a token named either by its secret or by its ID.
+func (s *server) resolveTokenID(token string, id string) (string, error) {
+	if token == "" {
+		return id, nil
+	}
+	info, err := s.store.getTokenInfo(token)
+	if err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
 
+// credentialID returns the ID of the token a credential authenticates with.
+func (s *server) credentialID(cred credential) (string, error) {
+	if cred.tokenID != "" {
+		return cred.tokenID, nil
+	}
+	info, err := s.store.getTokenInfo(cred.secret)
+	if err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// checkOutranks refuses to let a credential act on the token with a given ID unless it could have handed down
+// every grant of the token, its own and its roles': it must hold an admin permission itself, and either
+// ADM_TOKEN_GRANT or the permission itself for a data permission. Only a master admin token acts on another one.
+func (s *server) checkOutranks(cred credential, id string) error {
+	grants, err := s.store.getTokenGrants(id)
+	if err != nil {
+		return err
+	}
+	if isMasterAdm(grants) {
+		callerID, err := s.credentialID(cred)
+		if err != nil {
+			return err
+		}
+		callerGrants, err := s.store.getTokenGrants(callerID)
+		if err != nil {
+			return err
+		}
+		if !isMasterAdm(callerGrants) {
+			return errors.New("only a master admin token can act on a master admin token")
+		}
+	}
+
+	held, err := s.store.getTokenRoles(id)
+	if err != nil {
+		return err
+	}
+	if len(held) > 0 {
+		roles, err := s.store.listRoles()
+		if err != nil {
+			return err
+		}
+		for _, role := range roles {
+			if slices.Contains(held, role.Name) {
+				grants = append(grants, role.Grants...)
+			}
+		}
+	}
+	for _, grant := range grants {
+		if !isAdmPermission(grant.Permission) && s.store.getPermission(cred, grant.Context, "ADM_TOKEN_GRANT") == nil {
+			continue
+		}
+		callerGrants, err := s.store.getGrants(cred, grant.Context, grant.Permission)
+		if err != nil || !keyAllowed(callerGrants, grant.KeyPrefix) {
+			return errors.New("cannot act on a token holding " + grant.Permission + " on " + grant.Context + " without holding it")
+		}
+	}
+	return nil
+}
+
+// parseAdmRoleRequest reads the name of a role ("role").
+func parseAdmRoleRequest(r *http.Request) (string, error) {
+	defer r.Body.Close()
+
+	var data struct {
+		Role string `json:"role"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		return "", err
+	}
+	return data.Role, validateRoleName(data.Role)
+}
+
+// parseAdmRoleGrantRequest reads a role, a permission ("grant"), the context pattern it applies to ("context")
+// and the optional prefix of the keys it is limited to ("key_prefix").
+func parseAdmRoleGrantRequest(r *http.Request) (string, string, string, string, error) {
+	defer r.Body.Close()
+
+	var data struct {
+		Role      string `json:"role"`
+		Grant     string `json:"grant"`
+		Context   string `json:"context"`
+		KeyPrefix string `json:"key_prefix"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		return "", "", "", "", err
+	}
+
+	err = validateRoleName(data.Role)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	err = validateGrant(data.Grant)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	err = validateContextPattern(data.Context)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	return data.Role, data.Grant, data.Context, data.KeyPrefix, nil
+}
+
+// parseAdmTokenRoleRequest reads a token, either by its secret ("token") or by its ID ("id"), and a role ("role").
+func parseAdmTokenRoleRequest(r *http.Request) (string, string, string, error) {
+	defer r.Body.Close()
+
+	var data struct {
+		Token string `json:"token"`
+		ID    string `json:"id"`
+		Role  string `json:"role"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
 		return "", "", "", err
 	}
 
+	if (data.Token == "") == (data.ID == "") {
+		return "", "", "", errors.New("exactly one of token and id must be defined")
+	}
+	err = validateRoleName(data.Role)
+	if err != nil {
+		return "", "", "", err
+	}
+	return data.Token, data.ID, data.Role, nil
+}
+
+// tokenResponse describes a token, never including its secret.
+func tokenResponse(info tokenInfo) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":         info.ID,
+		"created_at": time.UnixMilli(info.CreatedAt).UTC().Format(time.RFC3339Nano),
+	}
+	if info.Name != "" {
+		response["name"] = info.Name
+	}
+	if len(info.Labels) > 0 {
+		response["labels"] = info.Labels
+	}
+	if info.ExpiresAt != 0 {
+		response["expires_at"] = time.UnixMilli(info.ExpiresAt).UTC().Format(time.RFC3339Nano)
+	}
+	if info.LastUsedAt != 0 {
+		response["last_used_at"] = time.UnixMilli(info.LastUsedAt).UTC().Format(time.RFC3339Nano)
+	}
+	return response
+}
+
+func parseAdmTokenGrantRequest(r *http.Request) (string, string, string, string, error) {
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		return "", "", "", "", err
+	}
+
 	defer r.Body.Close()
 
 	var data map[string]interface{}
@@ -81,28 +302,57 @@ func parseAdmTokenGrantRequest(r *http.Request) (string, string, string, error)
 	// Unmarshal the JSON string into the map
 	err = json.Unmarshal([]byte(body), &data)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", "", err
 	}
 
 	// Type assert the "token" field as a string
 	token, ok := data["token"].(string)
 	if !ok {
-		return "", "", "", errors.New("key token not defined")
+		return "", "", "", "", errors.New("key token not defined")
 	}
 
 	// Type assert the "grant" field as a string
 	grant, ok := data["grant"].(string)
 	if !ok {
-		return "", "", "", errors.New("key grant not defined")
+		return "", "", "", "", errors.New("key grant not defined")
 	}
 
 	// Type assert the "grant" field as a string
 	context, ok := data["context"].(string)
 	if !ok {
-		return "", "", "", errors.New("key context not defined")
+		return "", "", "", "", errors.New("key context not defined")
+	}
+
+	// The "key_prefix" field is optional, limiting the grant to the keys starting with it
+	keyPrefix := ""
+	if value, found := data["key_prefix"]; found {
+		keyPrefix, ok = value.(string)
+		if !ok {
+			return "", "", "", "", errors.New("key key_prefix must be a string")
+		}
+	}
+
+	return token, grant, context, keyPrefix, nil
+}
+
+// grantContext checks the context of a grant: a context pattern has to be valid,
+// while a context name has to exist.
+func (s *server) grantContext(context string) (string, error) {
+	if isContextPattern(context) {
+		return context, validateContextPattern(context)
 	}
+	return s.store.getContext(context)
+}
 
-	return token, grant, context, nil
+// validateTokenGrant checks a permission granted to a token, either a data permission or an admin one.
+func validateTokenGrant(grant string, keyPrefix string) error {
+	if !isAdmPermission(grant) {
+		return validateGrant(grant)
+	}
+	if keyPrefix != "" {
+		return errors.New("a key prefix only applies to data permissions")
+	}
+	return nil
 }
 
 func validateGrant(grant string) error {
@@ -126,8 +376,8 @@ func validateGrant(grant string) error {
 	return nil
 }
 
-func admContextPost(w http.ResponseWriter, r *http.Request) {
-	authToken, err := getHeaderAuthToken(r)
+func (s *server) admContextPost(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -138,79 +388,223 @@ func admContextPost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAudit(w, context, "", "")
+
+	err = s.store.getPermission(authToken, context, "ADM_CONTEXT_POST")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = validateContextName(context)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.createContext(context)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+}
+
+func (s *server) admContextGet(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-	db, err := connectSQLite()
+	context, err := parseAdmContextRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
+	noteAudit(w, context, "", "")
 
-	err = getPermission(db, authToken, "ALL", "ADM_CONTEXT_POST")
+	err = s.store.getPermission(authToken, context, "ADM_CONTEXT_GET")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if len(context) < 8 {
-		http.Error(w, errors.New("a context must to have at least 8 letters").Error(), http.StatusBadRequest)
+	context, err = s.store.getContext(context)
+
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
 		return
 	}
 
-	_, err = createContext(db, context)
+	successResponse := map[string]string{
+		"context": context,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(successResponse)
+
+}
 
+func (s *server) admContextDelete(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	context, err := parseAdmContextRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAudit(w, context, "", "")
 
-	err = createContextDataTable(db, context)
+	err = s.store.getPermission(authToken, context, "ADM_CONTEXT_DELETE")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = s.store.deleteContext(context)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+}
+
+func (s *server) admTokenPost(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	info, err := parseAdmTokenPostRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.getPermission(authToken, "ALL", "ADM_TOKEN_POST")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var token string
+	token, err = s.store.createToken(info)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	noteAuditAdmin(w, info.ID, "", "", "")
+
+	successResponse := tokenResponse(info)
+	successResponse["token"] = token
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(successResponse)
 
 }
 
-func admContextGet(w http.ResponseWriter, r *http.Request) {
-	authToken, err := getHeaderAuthToken(r)
+func (s *server) admTokenRotate(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	context, err := parseAdmContextRequest(r)
+	token, id, grace, err := parseAdmTokenRotateRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	db, err := connectSQLite()
+	err = s.store.getPermission(authToken, "ALL", "ADM_TOKEN_ROTATE")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	id, err = s.resolveTokenID(token, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
+	noteAuditAdmin(w, id, "", "", "")
+
+	// The new secret hands over every permission of the token.
+	err = s.checkOutranks(authToken, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	info, newToken, err := s.store.rotateToken(id, grace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	successResponse := tokenResponse(info)
+	successResponse["token"] = newToken
+	successResponse["rotated_id"] = id
+
+	// The client certificates mapped to the old ID stop acting as the token until the map names the new one.
+	if s.tls != nil {
+		if subjects := s.tls.subjectsOf(id); len(subjects) > 0 {
+			logStuff("token " + id + " was rotated to " + info.ID + ", the client certificates " +
+				strings.Join(subjects, "; ") + " are still mapped to the old ID in " + s.tls.clientMapFile)
+			successResponse["tls_client_subjects"] = subjects
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(successResponse)
 
-	err = getPermission(db, authToken, "ALL", "ADM_CONTEXT_GET")
+}
+
+func (s *server) admTokenList(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	context, err = getContext(db, context)
+	err = s.store.getPermission(authToken, "ALL", "ADM_TOKEN_GET")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
+	tokens, err := s.store.listTokens()
 	if err != nil {
-		http.Error(w, "", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	successResponse := map[string]string{
-		"context": context,
+	list := make([]map[string]interface{}, 0, len(tokens))
+	for _, info := range tokens {
+		list = append(list, tokenResponse(info))
+	}
+
+	successResponse := map[string]interface{}{
+		"tokens": list,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -219,40 +613,80 @@ func admContextGet(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func admContextDelete(w http.ResponseWriter, r *http.Request) {
-	authToken, err := getHeaderAuthToken(r)
+func (s *server) admTokenGrants(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	context, err := parseAdmContextRequest(r)
+	err = s.store.getPermission(authToken, "ALL", "ADM_TOKEN_GET")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	id := r.PathValue("id")
+	grants, err := s.store.getTokenGrants(id)
+	if errors.Is(err, errNoToken) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	db, err := connectSQLite()
+	roles, err := s.store.getTokenRoles(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
 
-	err = getPermission(db, authToken, "ALL", "ADM_CONTEXT_DELETE")
+	successResponse := map[string]interface{}{
+		"id":     id,
+		"grants": grantsResponse(grants),
+		"roles":  roles,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(successResponse)
+
+}
+
+func (s *server) admTokenDelete(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	err = deleteContext(db, context)
+	token, err := parseAdmTokenRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.getPermission(authToken, "ALL", "ADM_TOKEN_DELETE")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
+	id, err := s.resolveTokenID(token, "")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAuditAdmin(w, id, "", "", "")
+	err = s.checkOutranks(authToken, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	err = deleteContextDataTable(db, context)
+	err = s.store.deleteToken(token)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -264,71 +698,112 @@ func admContextDelete(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func admTokenPost(w http.ResponseWriter, r *http.Request) {
-	authToken, err := getHeaderAuthToken(r)
+func (s *server) admTokenGrant(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	db, err := connectSQLite()
+	token, grant, context, keyPrefix, err := parseAdmTokenGrantRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
+	noteAudit(w, context, "", "")
+	noteAuditAdmin(w, "", grant, "", keyPrefix)
+	if id, err := s.resolveTokenID(token, ""); err == nil {
+		noteAuditAdmin(w, id, "", "", "")
+	}
 
-	err = getPermission(db, authToken, "ALL", "ADM_TOKEN_POST")
+	err = validateTokenGrant(grant, keyPrefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.getPermission(authToken, context, "ADM_TOKEN_GRANT")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	var token string
-	token, err = createToken(db)
+	// An admin permission is only handed down by a token holding it on the context.
+	if isAdmPermission(grant) {
+		err = s.store.getPermission(authToken, context, grant)
+		if err != nil {
+			http.Error(w, "cannot grant "+grant+" without holding it on "+context, http.StatusForbidden)
+			return
+		}
+	}
 
+	context, err = s.grantContext(context)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	successResponse := map[string]string{
-		"token": token,
+	err = s.store.getToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.grantTokenPermission(token, grant, context, keyPrefix)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(successResponse)
 
 }
 
-func admTokenDelete(w http.ResponseWriter, r *http.Request) {
-	authToken, err := getHeaderAuthToken(r)
+func (s *server) admTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	token, err := parseAdmTokenRequest(r)
+	token, grant, context, _, err := parseAdmTokenGrantRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAudit(w, context, "", "")
+	noteAuditAdmin(w, "", grant, "", "")
+	if id, err := s.resolveTokenID(token, ""); err == nil {
+		noteAuditAdmin(w, id, "", "", "")
+	}
 
-	db, err := connectSQLite()
+	err = validateTokenGrant(grant, "")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
 
-	err = getPermission(db, authToken, "ALL", "ADM_TOKEN_DELETE")
+	err = s.store.getPermission(authToken, context, "ADM_TOKEN_REVOKE")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	err = deleteToken(db, token)
+	err = s.store.getToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	context, err = s.grantContext(context)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.rovokeTokenPermission(token, grant, context)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -337,56 +812,142 @@ func admTokenDelete(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+}
 
+// grantsResponse describes a list of grants.
+func grantsResponse(grants []tokenGrant) []map[string]string {
+	list := make([]map[string]string, 0, len(grants))
+	for _, grant := range grants {
+		item := map[string]string{
+			"permission": grant.Permission,
+			"context":    grant.Context,
+		}
+		if grant.KeyPrefix != "" {
+			item["key_prefix"] = grant.KeyPrefix
+		}
+		list = append(list, item)
+	}
+	return list
 }
 
-func admTokenGrant(w http.ResponseWriter, r *http.Request) {
-	authToken, err := getHeaderAuthToken(r)
+func (s *server) admRolePost(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	token, grant, context, err := parseAdmTokenGrantRequest(r)
+	name, err := parseAdmRoleRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAuditAdmin(w, "", "", name, "")
+
+	err = s.store.getPermission(authToken, "ALL", "ADM_ROLE_POST")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-	err = validateGrant(grant)
+	err = s.store.createRole(name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	db, err := connectSQLite()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *server) admRoleGet(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = s.store.getPermission(authToken, "ALL", "ADM_ROLE_GET")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roles, err := s.store.listRoles()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
 
-	err = getPermission(db, authToken, "ALL", "ADM_TOKEN_GRANT")
+	list := make([]map[string]interface{}, 0, len(roles))
+	for _, role := range roles {
+		list = append(list, map[string]interface{}{
+			"role":   role.Name,
+			"grants": grantsResponse(role.Grants),
+		})
+	}
+
+	successResponse := map[string]interface{}{
+		"roles": list,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(successResponse)
+}
+
+func (s *server) admRoleDelete(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	context, err = getContext(db, context)
+	name, err := parseAdmRoleRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	noteAuditAdmin(w, "", "", name, "")
+
+	err = s.store.getPermission(authToken, "ALL", "ADM_ROLE_DELETE")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
+	err = s.store.deleteRole(name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = getToken(db, token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) admRoleGrant(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	name, grant, pattern, keyPrefix, err := parseAdmRoleGrantRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAudit(w, pattern, "", "")
+	noteAuditAdmin(w, "", grant, name, keyPrefix)
 
-	_, _, _, err = grantTokenPermission(db, token, grant, context)
+	err = s.store.getPermission(authToken, "ALL", "ADM_ROLE_GRANT")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
+	err = s.store.grantRolePermission(name, grant, pattern, keyPrefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -394,61 +955,192 @@ func admTokenGrant(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *server) admRoleRevoke(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	name, grant, pattern, _, err := parseAdmRoleGrantRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	noteAudit(w, pattern, "", "")
+	noteAuditAdmin(w, "", grant, name, "")
+
+	err = s.store.getPermission(authToken, "ALL", "ADM_ROLE_REVOKE")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
+	err = s.store.revokeRolePermission(name, grant, pattern)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 }
 
-func admTokenRevoke(w http.ResponseWriter, r *http.Request) {
-	authToken, err := getHeaderAuthToken(r)
+func (s *server) admTokenRoleAssign(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	token, grant, context, err := parseAdmTokenGrantRequest(r)
+	token, id, name, err := parseAdmTokenRoleRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAuditAdmin(w, id, "", name, "")
 
-	err = validateGrant(grant)
+	err = s.store.getPermission(authToken, "ALL", "ADM_TOKEN_GRANT")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	id, err = s.resolveTokenID(token, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAuditAdmin(w, id, "", "", "")
 
-	db, err := connectSQLite()
+	err = s.store.assignRole(id, name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
 
-	err = getPermission(db, authToken, "ALL", "ADM_TOKEN_REVOKE")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *server) admTokenRoleUnassign(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	err = getToken(db, token)
+	token, id, name, err := parseAdmTokenRoleRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	noteAuditAdmin(w, id, "", name, "")
 
-	context, err = getContext(db, context)
+	err = s.store.getPermission(authToken, "ALL", "ADM_TOKEN_REVOKE")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	id, err = s.resolveTokenID(token, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	noteAuditAdmin(w, id, "", "", "")
 
+	err = s.store.unassignRole(id, name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = rovokeTokenPermission(db, token, grant, context)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
 
+// parseAdmAuditRequest parses the query string of an audit query.
+func parseAdmAuditRequest(r *http.Request) (auditQuery, error) {
+	query := r.URL.Query()
+	q := auditQuery{
+		tokenID: query.Get("token_id"),
+		action:  query.Get("action"),
+		context: query.Get("context"),
+		limit:   auditQueryDefaultLimit,
+	}
+
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > auditQueryMaxLimit {
+			return auditQuery{}, fmt.Errorf("limit must be a number between 1 and %d", auditQueryMaxLimit)
+		}
+		q.limit = limit
+	}
+
+	for name, bound := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+		if !query.Has(name) {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, query.Get(name))
+		if err != nil {
+			return auditQuery{}, errors.New(name + " must be an RFC 3339 time")
+		}
+		*bound = t
+	}
+
+	if q.context != "" {
+		err := validateContextPattern(q.context)
+		if err != nil {
+			return auditQuery{}, err
+		}
+	}
+	return q, nil
+}
+
+// admAudit handles GET /adm/audit returning the latest audit records, newest
+// first. A token holding ADM_AUDIT_GET on a context pattern only can query
+// the records of the contexts it covers.
+func (s *server) admAudit(w http.ResponseWriter, r *http.Request) {
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	q, err := parseAdmAuditRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	scope := q.context
+	if scope == "" {
+		scope = "ALL"
+	}
+	err = s.store.getPermission(authToken, scope, "ADM_AUDIT_GET")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if s.audit == nil {
+		http.Error(w, "audit log disabled", http.StatusNotFound)
+		return
+	}
+
+	records, err := s.audit.query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []auditRecord{}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"records": records})
 }
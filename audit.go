@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of an audited action.
+const (
+	auditSuccess = "success"
+	auditDenied  = "denied"
+	auditFailure = "failure"
+)
+
+// auditRedacted replaces the values in the audit log unless they are kept.
+const auditRedacted = "[redacted]"
+
+// Page sizes of the audit queries.
+const (
+	auditQueryDefaultLimit = 100
+	auditQueryMaxLimit     = 1000
+)
+
+// auditRecord is one line of the audit log. The token is only known by its
+// ID, never by its secret, and so is the token an administrative action is
+// about. Keys lists the keys of a batch or a multi-get.
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	TokenID       string    `json:"token_id,omitempty"`
+	Action        string    `json:"action"`
+	Context       string    `json:"context,omitempty"`
+	Key           string    `json:"key,omitempty"`
+	Keys          []string  `json:"keys,omitempty"`
+	Value         string    `json:"value,omitempty"`
+	TargetTokenID string    `json:"target_token_id,omitempty"`
+	Permission    string    `json:"permission,omitempty"`
+	Role          string    `json:"role,omitempty"`
+	KeyPrefix     string    `json:"key_prefix,omitempty"`
+	IP            string    `json:"ip"`
+	Status        int       `json:"status"`
+	Outcome       string    `json:"outcome"`
+}
+
+// auditLog appends audit records as JSON lines to a file, rotated once it
+// grows past maxSize: path is renamed path.1, path.1 path.2 and so on, the
+// oldest beyond maxFiles being removed.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	values   bool
+	reads    bool
+	file     *os.File
+	size     int64
+}
+
+// openAuditLog opens the audit log at path, appending to it. Values are only
+// recorded in clear when values is true, and reads only when reads is true.
+func openAuditLog(path string, maxSize int64, maxFiles int, values bool, reads bool) (*auditLog, error) {
+	if maxSize <= 0 || maxFiles < 1 {
+		return nil, errors.New("audit-max-size and audit-max-files must be positive")
+	}
+	a := &auditLog{path: path, maxSize: maxSize, maxFiles: maxFiles, values: values, reads: reads}
+	err := a.openLocked()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) openLocked() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// write appends a record, rotating the file first when it would grow past
+// maxSize. A record that can't be written is reported through logStuff.
+func (a *auditLog) write(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		logStuff("error on writing audit record: " + err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		err = a.rotateLocked()
+		if err != nil {
+			logStuff("error on rotating audit log: " + err.Error())
+		}
+	}
+	if a.file == nil {
+		return
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		logStuff("error on writing audit record: " + err.Error())
+	}
+}
+
+func (a *auditLog) rotateLocked() error {
+	err := a.file.Close()
+	a.file = nil
+	if err != nil {
+		return err
+	}
+	os.Remove(a.rotatedPath(a.maxFiles))
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		err = os.Rename(a.rotatedPath(i), a.rotatedPath(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	err = os.Rename(a.path, a.rotatedPath(1))
+	if err != nil {
+		return err
+	}
+	return a.openLocked()
+}
+
+func (a *auditLog) rotatedPath(i int) string {
+	return a.path + "." + strconv.Itoa(i)
+}
+
+// close syncs and closes the audit log file.
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.file = nil
+	return err
+}
+
+// auditQuery selects audit records: those of a token, of an action, on the
+// contexts covered by a context or pattern, and in a time range. Empty
+// fields select everything.
+type auditQuery struct {
+	tokenID string
+	action  string
+	context string
+	since   time.Time
+	until   time.Time
+	limit   int
+}
+
+func (q auditQuery) matches(record auditRecord) bool {
+	return (q.tokenID == "" || record.TokenID == q.tokenID) &&
+		(q.action == "" || record.Action == q.action) &&
+		(q.context == "" || record.Context != "" && contextCovers(q.context, record.Context)) &&
+		(q.since.IsZero() || !record.Time.Before(q.since)) &&
+		(q.until.IsZero() || record.Time.Before(q.until))
+}
+
+// openFiles opens the current and rotated files, from the oldest to the
+// current one. They are opened together under the lock, so a rotation can't
+// make a query miss or repeat a file, but read without it, never blocking
+// the writes.
+func (a *auditLog) openFiles() ([]*os.File, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var files []*os.File
+	for i := a.maxFiles; i >= 0; i-- {
+		path := a.path
+		if i > 0 {
+			path = a.rotatedPath(i)
+		}
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// query returns the latest records matching q, newest first, reading the
+// rotated files too.
+func (a *auditLog) query(q auditQuery) ([]auditRecord, error) {
+	files, err := a.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	// Read from the oldest file to the current one, keeping the latest
+	// matching records.
+	var records []auditRecord
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record auditRecord
+			if json.Unmarshal(scanner.Bytes(), &record) != nil || !q.matches(record) {
+				continue
+			}
+			records = append(records, record)
+			if len(records) > q.limit {
+				records = records[1:]
+			}
+		}
+		err = scanner.Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// auditWriter records the status of a response and what the handler tells
+// about the action, for the audit record written once it returns.
+type auditWriter struct {
+	http.ResponseWriter
+	log    *auditLog
+	record auditRecord
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.record.Status == 0 {
+		w.record.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.record.Status == 0 {
+		w.record.Status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses through the audit.
+func (w *auditWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// audited wraps a handler so every call is recorded in the audit log as
+// action. The context and the key are taken from the path, handlers reading
+// them from the body tell them with noteAudit.
+func (s *server) audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return s.auditHandler(action, false, handler)
+}
+
+// auditedRead is audited for the handlers only reading entries, recorded
+// when the audit log keeps reads.
+func (s *server) auditedRead(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return s.auditHandler(action, true, handler)
+}
+
+func (s *server) auditHandler(action string, read bool, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.audit == nil || read && !s.audit.reads {
+			handler(w, r)
+			return
+		}
+
+		record := auditRecord{
+			Time:   time.Now().UTC(),
+			Action: action,
+			IP:     r.RemoteAddr,
+		}
+		// Data routes name the context and the key in their path.
+		if strings.HasPrefix(r.URL.Path, "/con/") {
+			record.Context = r.PathValue("id")
+			record.Key = r.PathValue("key")
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			record.IP = host
+		}
+		// The token of a bearer secret is the one the store finds checking
+		// its permissions, before the action may remove it.
+		var resolved string
+		r = r.WithContext(context.WithValue(r.Context(), resolvedTokenIDKey{}, &resolved))
+
+		aw := &auditWriter{ResponseWriter: w, log: s.audit, record: record}
+		handler(aw, r)
+
+		aw.record.TokenID = resolved
+		if cred, err := s.requestCredential(r); err == nil && cred.tokenID != "" {
+			aw.record.TokenID = cred.tokenID
+		}
+
+		switch status := aw.record.Status; {
+		case status == 0:
+			aw.record.Status = http.StatusOK
+			aw.record.Outcome = auditSuccess
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			aw.record.Outcome = auditDenied
+		case status >= http.StatusBadRequest:
+			aw.record.Outcome = auditFailure
+		default:
+			aw.record.Outcome = auditSuccess
+		}
+		s.audit.write(aw.record)
+	}
+}
+
+// resolvedTokenIDKey is the key of the request context value receiving the ID
+// of the token of the request, set by auditHandler and handed to the stores
+// by requestCredential.
+type resolvedTokenIDKey struct{}
+
+// noteAudit tells the audit log the context, key and value an action is
+// about, when the response is audited. The value is redacted unless the
+// audit log keeps values.
+func noteAudit(w http.ResponseWriter, context string, key string, value string) {
+	aw, ok := w.(*auditWriter)
+	if !ok {
+		return
+	}
+	aw.record.Context = context
+	aw.record.Key = key
+	if value != "" && !aw.log.values {
+		value = auditRedacted
+	}
+	aw.record.Value = value
+}
+
+// noteAuditKeys tells the audit log the keys of a batch or a multi-get.
+func noteAuditKeys(w http.ResponseWriter, keys []string) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.record.Keys = keys
+	}
+}
+
+// noteAuditAdmin tells the audit log the token, permission, role and key
+// prefix an administrative action is about. Empty arguments leave what was
+// told before, so a handler tells the target token once it is resolved.
+func noteAuditAdmin(w http.ResponseWriter, targetTokenID string, permission string, role string, keyPrefix string) {
+	aw, ok := w.(*auditWriter)
+	if !ok {
+		return
+	}
+	if targetTokenID != "" {
+		aw.record.TargetTokenID = targetTokenID
+	}
+	if permission != "" {
+		aw.record.Permission = permission
+	}
+	if role != "" {
+		aw.record.Role = role
+	}
+	if keyPrefix != "" {
+		aw.record.KeyPrefix = keyPrefix
+	}
+}
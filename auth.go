@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A token holds a permission on a context when one of its grants, its own or
+// one of its roles', covers the context. The context of a grant is either a
+// context name or a glob pattern: "*" matches any run of characters, "?" any
+// single character and "[...]" a character class, so "tenant42_*" covers
+// every context starting with "tenant42_". "ALL" is an alias of "*".
+//
+// Grants only ever add permissions: when several grants of a permission cover
+// a context, they all apply. The stores hand the raw grants of a token to
+// matchingGrants, so both evaluate them the same way.
+//
+// Admin permissions are granted on contexts the same way. Those acting on a
+// context, like ADM_CONTEXT_POST or ADM_TOKEN_GRANT, are checked against it,
+// where a grant on a pattern only covers a narrower pattern: "team1_*" covers
+// "team1_billing" and "team1_b*" but not "team*". The others act on every
+// context, they are checked against "ALL" and only "ALL" and "*" cover it.
+//
+// A grant can also be limited to the keys starting with a prefix. A key is
+// reachable when any of the grants covering the context reaches it, so a grant
+// on "svc:" keys next to one on "*" without a prefix reaches every key.
+
+// credential is what a request authenticates with: the secret of a bearer
+// token, or the ID of the token its client certificate is mapped to. When
+// resolved isn't nil, the store checking the credential writes there the ID
+// of the token it found, so the audit log doesn't look it up again.
+type credential struct {
+	secret   string
+	tokenID  string
+	resolved *string
+}
+
+// resolve tells the ID of the token a credential was found to be.
+func (c credential) resolve(id string) {
+	if c.resolved != nil && id != "" {
+		*c.resolved = id
+	}
+}
+
+// roleNamePattern is the grammar of role names.
+var roleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// role is a named set of permissions on context patterns.
+type role struct {
+	Name   string
+	Grants []tokenGrant
+}
+
+// errNoRole is returned when a role doesn't exist.
+var errNoRole = errors.New("role does not exist")
+
+// isContextPattern reports whether the context of a grant is a pattern
+// rather than a context name.
+func isContextPattern(context string) bool {
+	return context == "ALL" || strings.ContainsAny(context, "*?[")
+}
+
+// contextMatches reports whether the context of a grant covers context.
+func contextMatches(pattern string, context string) bool {
+	if pattern == "ALL" {
+		return true
+	}
+	if !isContextPattern(pattern) {
+		return pattern == context
+	}
+	matched, err := path.Match(pattern, context)
+	return err == nil && matched
+}
+
+// contextCovers reports whether the context of a grant covers target, a
+// context name or a pattern. A pattern is covered by itself, by "ALL" and "*",
+// and by a pattern ending in a single "*" after a literal start of its own.
+func contextCovers(pattern string, target string) bool {
+	if pattern == "ALL" || pattern == "*" {
+		return true
+	}
+	if !isContextPattern(target) {
+		return contextMatches(pattern, target)
+	}
+	if pattern == target {
+		return true
+	}
+	literal, ok := strings.CutSuffix(pattern, "*")
+	if !ok || isContextPattern(literal) {
+		return false
+	}
+	return strings.HasPrefix(target[:specificity(target)], literal)
+}
+
+// specificity ranks the context of a grant, the higher the more specific.
+func specificity(pattern string) int {
+	if !isContextPattern(pattern) {
+		return math.MaxInt
+	}
+	if pattern == "ALL" {
+		return 0
+	}
+	return strings.IndexAny(pattern, "*?[")
+}
+
+// matchingGrants returns the grants of permission covering context, a context
+// name or a pattern.
+func matchingGrants(grants []tokenGrant, permission string, context string) []tokenGrant {
+	var matching []tokenGrant
+	for _, grant := range grants {
+		if grant.Permission == permission && contextCovers(grant.Context, context) {
+			matching = append(matching, grant)
+		}
+	}
+	return matching
+}
+
+// keyAllowed reports whether one of grants covers key. Given a key prefix
+// rather than a key, it reports whether they cover every key starting with it.
+func keyAllowed(grants []tokenGrant, key string) bool {
+	for _, grant := range grants {
+		if strings.HasPrefix(key, grant.KeyPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRoleName checks a role name against roleNamePattern.
+func validateRoleName(name string) error {
+	if !roleNamePattern.MatchString(name) {
+		return errors.New("a role name must have 1 to 64 letters, digits, _ or -")
+	}
+	return nil
+}
+
+// validateContextPattern checks that the context of a grant is a valid
+// glob pattern.
+func validateContextPattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("context pattern not defined")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.New("invalid context pattern " + pattern)
+	}
+	return nil
+}
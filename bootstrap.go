@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// admTokenEnv is the environment variable an operator can provide the master
+// admin token in, instead of having it generated at first boot.
+const admTokenEnv = "WALKYRIA_ADMIN_TOKEN"
+
+// admTokenMinLength is the length a provided master admin token must reach.
+const admTokenMinLength = 16
+
+// Where a generated master admin token goes: written to a file next to the
+// database, printed on the standard output, or never shown at all.
+const (
+	admTokenOutputFile   = "file"
+	admTokenOutputStdout = "stdout"
+	admTokenOutputNone   = "none"
+)
+
+// validateAdmTokenOutput checks the destination of a generated master admin
+// token.
+func validateAdmTokenOutput(output string) error {
+	switch output {
+	case admTokenOutputFile, admTokenOutputStdout, admTokenOutputNone:
+		return nil
+	}
+	return errors.New("admin-token-output must be file, stdout or none")
+}
+
+// providedAdmToken returns the master admin token provided in admTokenEnv or
+// in secretFile, or an empty string when none is. The variable is removed
+// from the environment once read, so the secret isn't handed down to child
+// processes or left in the process environment.
+func providedAdmToken(secretFile string) (string, error) {
+	secret := os.Getenv(admTokenEnv)
+	os.Unsetenv(admTokenEnv)
+	if secretFile != "" {
+		if secret != "" {
+			return "", errors.New("provide the admin token either in " + admTokenEnv + " or in admin-token-file, not both")
+		}
+		content, err := os.ReadFile(secretFile)
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimSpace(string(content))
+		if secret == "" {
+			return "", errors.New("admin-token-file " + secretFile + " is empty")
+		}
+	}
+	if secret != "" && len(secret) < admTokenMinLength {
+		return "", fmt.Errorf("the provided admin token must have at least %d characters", admTokenMinLength)
+	}
+	return secret, nil
+}
+
+// bootstrapAdmToken creates the master admin token at first boot, from the
+// provided secret if any. A generated secret goes to output, tokenPath for the
+// file output, a provided one is never shown since the operator already holds
+// it.
+func bootstrapAdmToken(s Store, secretFile string, output string, tokenPath string) error {
+	secret, err := providedAdmToken(secretFile)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.createAdmToken(secret)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case token == "" && secret != "":
+		fmt.Println("ADM TOKEN ALREADY CREATED, the provided admin token is ignored")
+	case token == "":
+		fmt.Println("ADM TOKEN ALREADY CREATED")
+	case secret != "":
+		fmt.Println("Master adm token created from the provided secret")
+	case output == admTokenOutputStdout:
+		fmt.Println("Master adm token : " + token)
+	case output == admTokenOutputFile:
+		err = writeSecretFile(tokenPath, token)
+		if err != nil {
+			return errors.New(err.Error() + ", run reset-admin to get a new admin token")
+		}
+	default:
+		fmt.Println("Master adm token created, run reset-admin to get one")
+	}
+	return nil
+}
+
+// writeSecretFile writes a secret to a file readable by its owner only,
+// replacing the file if it exists.
+func writeSecretFile(path string, secret string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	// A file that already existed keeps its mode when opened.
+	err = file.Chmod(0o600)
+	if err == nil {
+		_, err = file.WriteString(secret + "\n")
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New("writing " + path + ": " + err.Error())
+	}
+	fmt.Println("Master adm token written to " + path)
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The configuration of the server is layered: every setting has a default,
+// overridden by the configuration file, then by the environment, then by the
+// command line. A setting has the same name everywhere: "db-busy-timeout" is
+// the -db-busy-timeout flag, the "db-busy-timeout" key of the file and the
+// WALKYRIA_DB_BUSY_TIMEOUT environment variable.
+
+// configEnvPrefix starts the environment variables holding settings.
+const configEnvPrefix = "WALKYRIA_"
+
+// configFileEnv names the configuration file when -config doesn't.
+const configFileEnv = configEnvPrefix + "CONFIG"
+
+// config holds every setting of the server.
+type config struct {
+	bind               string
+	port               int
+	logFile            string
+	storeKind          string
+	dbPath             string
+	dbBusyTimeout      time.Duration
+	dbMaxConns         int
+	walFsync           string
+	snapshotInterval   time.Duration
+	reapInterval       time.Duration
+	reapBatch          int
+	tokenPurgeInterval time.Duration
+	admTokenFile       string
+	admTokenOutput     string
+	auditFile          string
+	auditMaxSize       int64
+	auditMaxFiles      int
+	auditValues        bool
+	auditReads         bool
+	tlsCert            string
+	tlsKey             string
+	tlsClientCA        string
+	tlsClientAuth      string
+	tlsClientMap       string
+	tlsReloadInterval  time.Duration
+	shutdownTimeout    time.Duration
+}
+
+// configFlags returns the flags of every setting of c, holding their defaults,
+// plus -config naming the configuration file.
+func configFlags(name string, c *config, configFile *string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(configFile, "config", "", "Define the JSON configuration file, instead of "+configFileEnv)
+
+	flags.StringVar(&c.bind, "bind", "", "Define the address the server listens on, empty for every interface")
+	flags.IntVar(&c.port, "port", 53072, "Define the port number")
+	flags.StringVar(&c.logFile, "log-file", "", "Define the file the logs are appended to, empty for the standard error")
+	flags.StringVar(&c.storeKind, "store", "sqlite", "Define the storage engine: sqlite or memory")
+	flags.StringVar(&c.dbPath, "db", defaultDBPath, "Define the SQLite database file, the other data files are kept next to it")
+	flags.DurationVar(&c.dbBusyTimeout, "db-busy-timeout", 5*time.Second, "Define how long a request waits for the SQLite database to be unlocked")
+	flags.IntVar(&c.dbMaxConns, "db-max-conns", 8, "Define how many connections to the SQLite database are kept open")
+	flags.StringVar(&c.walFsync, "wal-fsync", "always", "Define when the write-ahead log is fsynced: always, never or an interval like 100ms")
+	flags.DurationVar(&c.snapshotInterval, "snapshot-interval", 10*time.Minute, "Define how often the memory store is snapshotted and its log compacted, 0 disables it")
+	flags.DurationVar(&c.reapInterval, "reap-interval", time.Second, "Define how often expired entries are removed")
+	flags.IntVar(&c.reapBatch, "reap-batch", 500, "Define how many expired entries are removed at once")
+	flags.DurationVar(&c.tokenPurgeInterval, "token-purge-interval", time.Minute, "Define how often expired tokens and their permissions are removed")
+	flags.StringVar(&c.admTokenFile, "admin-token-file", "", "Define a file holding the master admin token to create at first boot, instead of "+admTokenEnv)
+	flags.StringVar(&c.admTokenOutput, "admin-token-output", admTokenOutputFile, "Define where a generated master admin token goes: file ("+admTokenFileName+" next to the database), stdout or none")
+	flags.StringVar(&c.auditFile, "audit-file", "./audit.log", "Define the file the audit log is written to, empty disables it")
+	flags.Int64Var(&c.auditMaxSize, "audit-max-size", 10, "Define the size in megabytes the audit log is rotated at")
+	flags.IntVar(&c.auditMaxFiles, "audit-max-files", 5, "Define how many rotated audit log files are kept")
+	flags.BoolVar(&c.auditValues, "audit-values", false, "Define if the audit log records the values written instead of redacting them")
+	flags.BoolVar(&c.auditReads, "audit-reads", false, "Define if the audit log records the reads of entries too")
+	flags.StringVar(&c.tlsCert, "tls-cert", "", "Define the certificate file of the server, which then only serves HTTPS")
+	flags.StringVar(&c.tlsKey, "tls-key", "", "Define the private key file of the server certificate")
+	flags.StringVar(&c.tlsClientCA, "tls-client-ca", "", "Define the CA bundle client certificates are verified against")
+	flags.StringVar(&c.tlsClientAuth, "tls-client-auth", tlsClientAuthOptional, "Define if a client certificate is optional or required, once tls-client-ca is set")
+	flags.StringVar(&c.tlsClientMap, "tls-client-map", "", "Define the JSON file mapping client certificate subjects to token IDs")
+	flags.DurationVar(&c.tlsReloadInterval, "tls-reload-interval", 10*time.Second, "Define how often the TLS files are checked for changes")
+	flags.DurationVar(&c.shutdownTimeout, "shutdown-timeout", 25*time.Second, "Define how long the requests in flight are waited for on SIGINT or SIGTERM")
+	return flags
+}
+
+// loadConfig parses args with flags, created by configFlags, and layers the
+// configuration file and the environment under them. It returns flag.ErrHelp
+// when the usage was asked for.
+func loadConfig(flags *flag.FlagSet, args []string, configFile *string) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	// Keep the flags given, to apply them again over the other layers.
+	given := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	if *configFile == "" {
+		*configFile = os.Getenv(configFileEnv)
+	}
+	if *configFile != "" {
+		err = loadConfigFile(flags, *configFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		if !isSetting(f.Name) {
+			return
+		}
+		value, ok := os.LookupEnv(configEnvName(f.Name))
+		if !ok {
+			return
+		}
+		err := f.Value.Set(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", value, configEnvName(f.Name), err))
+		}
+	})
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for name, value := range given {
+		flags.Lookup(name).Value.Set(value)
+	}
+	return nil
+}
+
+// loadConfigFile applies the settings of a JSON configuration file, an object
+// of settings by name. Only the .json extension is accepted, a YAML or TOML
+// file would otherwise fail with a confusing JSON syntax error.
+func loadConfigFile(flags *flag.FlagSet, path string) error {
+	if !strings.EqualFold(filepath.Ext(path), ".json") {
+		return fmt.Errorf("reading %s: the configuration file must be a JSON file named *.json", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var settings map[string]any
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	err = decoder.Decode(&settings)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		raw := settings[name]
+		f := flags.Lookup(name)
+		if !isSetting(name) {
+			errs = append(errs, fmt.Errorf("reading %s: unknown setting %s", path, name))
+			continue
+		}
+		var value string
+		switch raw := raw.(type) {
+		case string:
+			value = raw
+		case json.Number:
+			value = raw.String()
+		case bool:
+			value = strconv.FormatBool(raw)
+		default:
+			errs = append(errs, fmt.Errorf("reading %s: %s must be a string, a number or a boolean", path, name))
+			continue
+		}
+		err = f.Value.Set(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading %s: invalid value %q for %s: %v", path, value, name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isSetting reports whether a flag is a setting, rather than -config or a
+// flag of a subcommand.
+func isSetting(name string) bool {
+	var c config
+	var configFile string
+	return name != "config" && configFlags("", &c, &configFile).Lookup(name) != nil
+}
+
+// configEnvName returns the environment variable of a setting.
+func configEnvName(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// validate checks the settings together, reporting every invalid one.
+func (c config) validate() error {
+	var errs []error
+	if c.port < 1 || c.port > 65535 {
+		errs = append(errs, errors.New("port must be between 1 and 65535"))
+	}
+	if c.storeKind != "sqlite" && c.storeKind != "memory" {
+		errs = append(errs, errors.New("unknown store "+c.storeKind+", use sqlite or memory"))
+	}
+	if c.dbPath == "" {
+		errs = append(errs, errors.New("db must name the database file"))
+	}
+	if c.dbBusyTimeout < 0 || c.dbMaxConns < 1 {
+		errs = append(errs, errors.New("db-busy-timeout can't be negative and db-max-conns must be positive"))
+	}
+	if _, err := parseFsyncPolicy(c.walFsync); err != nil {
+		errs = append(errs, err)
+	}
+	if c.snapshotInterval < 0 {
+		errs = append(errs, errors.New("snapshot-interval can't be negative"))
+	}
+	if c.reapInterval <= 0 || c.reapBatch < 1 {
+		errs = append(errs, errors.New("reap-interval and reap-batch must be positive"))
+	}
+	if c.tokenPurgeInterval <= 0 {
+		errs = append(errs, errors.New("token-purge-interval must be positive"))
+	}
+	if err := validateAdmTokenOutput(c.admTokenOutput); err != nil {
+		errs = append(errs, err)
+	}
+	if c.auditFile != "" && (c.auditMaxSize <= 0 || c.auditMaxFiles < 1) {
+		errs = append(errs, errors.New("audit-max-size and audit-max-files must be positive"))
+	}
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be set together"))
+	}
+	if c.tlsClientCA != "" && c.tlsCert == "" {
+		errs = append(errs, errors.New("tls-client-ca needs tls-cert and tls-key"))
+	}
+	if c.tlsClientMap != "" && c.tlsClientCA == "" {
+		errs = append(errs, errors.New("tls-client-map needs tls-client-ca"))
+	}
+	if c.tlsClientAuth != tlsClientAuthOptional && c.tlsClientAuth != tlsClientAuthRequire {
+		errs = append(errs, errors.New("tls-client-auth must be optional or require"))
+	}
+	if c.tlsReloadInterval <= 0 {
+		errs = append(errs, errors.New("tls-reload-interval must be positive"))
+	}
+	if c.shutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown-timeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// storeOptions returns the options the store is opened with.
+func (c config) storeOptions() storeOptions {
+	return storeOptions{
+		kind:             c.storeKind,
+		dbPath:           c.dbPath,
+		busyTimeout:      c.dbBusyTimeout,
+		maxConns:         c.dbMaxConns,
+		walFsync:         c.walFsync,
+		snapshotInterval: c.snapshotInterval,
+	}
+}
+
+// runConfig is the config subcommand, printing the effective configuration
+// as a JSON configuration file, then checking it.
+func runConfig(args []string) error {
+	var c config
+	var configFile string
+	flags := configFlags("config", &c, &configFile)
+	err := loadConfig(flags, args, &configFile)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	settings := map[string]any{}
+	flags.VisitAll(func(f *flag.Flag) {
+		if !isSetting(f.Name) {
+			return
+		}
+		value := f.Value.(flag.Getter).Get()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		settings[f.Name] = value
+	})
+	out, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return c.validate()
+}
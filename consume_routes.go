@@ -1,342 +1,1296 @@
-package main
-
-import (
-	"encoding/json"
-	"errors"
-	"io"
-	"net/http"
-	"strings"
-)
-
-// getHeaderAuthToken extracts the Bearer token from the Authorization header in an HTTP request.
-// It returns the token string or an error if the header is missing or improperly formatted.
-func getHeaderAuthToken(r *http.Request) (string, error) {
-	// Get the value of the Authorization header from the request.
-	authHeader := r.Header.Get("Authorization")
-	
-	// If the Authorization header is empty, return an error indicating it's missing.
-	if authHeader == "" {
-		return "", errors.New("authorization header missing")
-	}
-
-	// Split the Authorization header into two parts: the scheme ("Bearer") and the token.
-	tokenParts := strings.Split(authHeader, " ")
-
-	// Check that the header is correctly formatted as "Bearer <token>".
-	// If the length isn't 2 or the scheme isn't "Bearer", return an error for invalid format.
-	if len(tokenParts) != 2 || strings.ToLower(tokenParts[0]) != "bearer" {
-		return "", errors.New("invalid Authorization header format")
-	}
-
-	// Return the token (the second part of the split header) and no error.
-	return tokenParts[1], nil
-}
-
-// parseConRequest parses an HTTP request and extracts a context, key, and value from the request body.
-// It expects a JSON body with exactly one key-value pair and returns an error if this condition isn't met.
-func parseConRequest(r *http.Request) (string, string, string, error) {
-	// Read the entire body of the request.
-	body, err := io.ReadAll(r.Body)
-
-	// If reading the body fails, return an empty response and the error.
-	if err != nil {
-		return "", "", "", err
-	}
-
-	// Ensure the request body is closed after the function completes.
-	defer r.Body.Close()
-
-	// Create a map to hold the parsed JSON data.
-	var data map[string]interface{}
-
-	// Unmarshal the JSON body into the `data` map.
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		return "", "", "", err // Return an error if the JSON parsing fails.
-	}
-
-	// Extract the "id" from the request path as the context (assuming r.PathValue is a valid method).
-	context := r.PathValue("id")
-
-	// Ensure the JSON body contains exactly one key-value pair.
-	if len(data) == 1 {
-		// Since Go maps do not have a direct way to access the first element, we manually iterate over the map.
-		for key, value := range data {
-
-			// Type assert the value to a string. If the value is not a string, return an error.
-			valueStr, ok := value.(string)
-			if !ok {
-				return "", "", "", errors.New("value is not a string") // Handle the case where the value isn't a string.
-			}
-
-			// If everything is successful, return the context (id), the key, and the string value.
-			return context, key, valueStr, nil
-		}
-	}
-	
-	// Return an error if the JSON body does not contain exactly one key-value pair.
-	return "", "", "", errors.New("JSON body must have 1 key-value pair")
-}
-
-// conPost handles HTTP POST requests to create a new entry in the database.
-// It performs authentication, parses the request, checks permissions, and then inserts the entry into the database.
-func conPost(w http.ResponseWriter, r *http.Request) {
-	// Extract the authorization token from the request header.
-	authToken, err := getHeaderAuthToken(r)
-	// If the token is missing or invalid, return a 401 Unauthorized error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Parse the context, key, and value from the request body.
-	context, key, value, err := parseConRequest(r)
-	// If the request body is invalid or improperly formatted, return a 400 Bad Request error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Establish a connection to the SQLite database.
-	db, err := connectSQLite()
-	// If the connection to the database fails, return a 400 Bad Request error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	// Ensure the database connection is closed when the function completes.
-	defer db.Close()
-
-	// Verify that the authenticated user has permission to perform the POST operation in the given context.
-	err = getPermission(db, authToken, context, "POST")
-	// If the user lacks the necessary permissions, return a 401 Unauthorized error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Retrieve and verify the actual context from the database (e.g., normalizing or ensuring its existence).
-	context, err = getContext(db, context)
-	// If the context is invalid or not found, return a 400 Bad Request error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Create a new entry in the database using the context, key, and value.
-	_, _, _, err = createEntry(db, context, key, value)
-	// If the entry creation fails, return a 400 Bad Request error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	
-	successResponse := map[string]string{
-		"key":key,
-		"value":value,
-		"context":context,
-		"status":"created",
-	}
-
-	// Set the response header to JSON and respond with the success response.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(successResponse)
-
-}
-
-// conPut handles HTTP PUT requests to update an existing entry in the database.
-func conPut(w http.ResponseWriter, r *http.Request) {
-	// Extract the authorization token from the request header.
-	authToken, err := getHeaderAuthToken(r)
-	// If the token is missing or invalid, return a 401 Unauthorized error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Extract the context (id) from the request path.
-	context := r.PathValue("id")
-
-	// Establish a connection to the SQLite database.
-	db, err := connectSQLite()
-	// If the connection to the database fails, return a 400 Bad Request error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	// Ensure the database connection is closed when the function completes.
-	defer db.Close()
-
-	// Verify that the authenticated user has permission to perform the PUT operation in the given context.
-	err = getPermission(db, authToken, context, "PUT")
-	// If the user lacks the necessary permissions, return a 401 Unauthorized error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Retrieve and verify the actual context from the database.
-	_, err = getContext(db, context)
-	// If the context is invalid or not found, return a 400 Bad Request error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Parse the context, key, and value from the request body.
-	context, key, value, err := parseConRequest(r)
-	// If the request body is invalid or improperly formatted, return a 400 Bad Request error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Update the existing entry in the database using the context, key, and value.
-	_, _, _, err = updateEntry(db, context, key, value)
-	// If the entry update fails, return a 400 Bad Request error.
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	successResponse := map[string]string{
-		"key":key,
-		"value":value,
-		"context":context,
-		"status":"updated",
-	}
-
-	// Set the response header to JSON and respond with the success response.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(successResponse)
-
-}
-
-// conGet handles GET requests to retrieve a specific entry.
-func conGet(w http.ResponseWriter, r *http.Request) {
-	// Extract the authorization token from the request header.
-	authToken, err := getHeaderAuthToken(r)
-	if err != nil {
-		// If there's an error, respond with an unauthorized status.
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Get the context ID from the request path.
-	context := r.PathValue("id")
-
-	// Connect to the SQLite database.
-	db, err := connectSQLite()
-	if err != nil {
-		// If there's an error, respond with a bad request status.
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	defer db.Close() // Ensure the database connection is closed.
-
-	// Check if the user has permission to perform the GET operation.
-	err = getPermission(db, authToken, context, "GET")
-	if err != nil {
-		// If there's an error, respond with an unauthorized status.
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Retrieve the context from the database.
-	_, err = getContext(db, context)
-	if err != nil {
-		// If there's an error, respond with a bad request status.
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Parse the request to get the context and value.
-	context, _, value, err := parseConRequest(r)
-	if err != nil {
-		// If there's an error, respond with a bad request status.
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	var key string
-	// Retrieve the entry from the database.
-	_, key, value, err = getEntry(db, context, value)
-	if err != nil {
-		// If there's an error, respond with a not found status.
-		http.Error(w, "", http.StatusNotFound)
-		return
-	}
-
-	// Create a response map with the retrieved key-value pair.
-	successResponse := map[string]string{
-		"key":key,
-		"value":value,
-		"context":context,
-	}
-
-	// Set the response header to JSON and respond with the success response.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(successResponse)
-}
-
-// conDelete handles DELETE requests to remove a specific entry.
-func conDelete(w http.ResponseWriter, r *http.Request) {
-	// Extract the authorization token from the request header.
-	authToken, err := getHeaderAuthToken(r)
-	if err != nil {
-		// If there's an error, respond with an unauthorized status.
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Get the context ID from the request path.
-	context := r.PathValue("id")
-
-	// Connect to the SQLite database.
-	db, err := connectSQLite()
-	if err != nil {
-		// If there's an error, respond with a bad request status.
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	defer db.Close() // Ensure the database connection is closed.
-
-	// Check if the user has permission to perform the DELETE operation.
-	err = getPermission(db, authToken, context, "PUT")
-	if err != nil {
-		// If there's an error, respond with an unauthorized status.
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Retrieve the context from the database.
-	_, err = getContext(db, context)
-	if err != nil {
-		// If there's an error, respond with a bad request status.
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Parse the request to get the context and key.
-	context, _, key, err := parseConRequest(r)
-	if err != nil {
-		// If there's an error, respond with a bad request status.
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Delete the entry from the database.
-	err = deleteEntry(db, context, key)
-	if err != nil {
-		// If there's an error, respond with a bad request status.
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Set the response header to JSON and respond with a success status.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusNoContent)
-}
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of the context listings.
+const (
+	conListDefaultLimit = 100
+	conListMaxLimit     = 1000
+)
+
+// conBatchMaxOperations is the number of operations a batch can hold.
+const conBatchMaxOperations = 1000
+
+// conMultiGetMaxKeys is the number of keys a multi-get can ask for.
+const conMultiGetMaxKeys = 1000
+
+// conBatchVerbs maps the operations of a batch to the permission each of them needs.
+var conBatchVerbs = map[string]string{
+	batchCreate: "POST",
+	batchUpdate: "PUT",
+	batchDelete: "DELETE",
+	batchGet:    "GET",
+}
+
+// conReservedKeys are the names of the endpoints under /con/{id}, which can't be created as keys since their
+// routes would shadow them.
+var conReservedKeys = []string{"_batch", "_mget", "_watch"}
+
+// validateNewKey checks the key of an entry about to be created.
+func validateNewKey(key string) error {
+	if key == "" {
+		return errors.New("key not defined")
+	}
+	if slices.Contains(conReservedKeys, key) {
+		return errors.New("key " + key + " is reserved")
+	}
+	return nil
+}
+
+// getHeaderAuthToken extracts the Bearer token from the Authorization header in an HTTP request.
+// It returns the token string or an error if the header is missing or improperly formatted.
+func getHeaderAuthToken(r *http.Request) (string, error) {
+	// Get the value of the Authorization header from the request.
+	authHeader := r.Header.Get("Authorization")
+	
+	// If the Authorization header is empty, return an error indicating it's missing.
+	if authHeader == "" {
+		return "", errors.New("authorization header missing")
+	}
+
+	// Split the Authorization header into two parts: the scheme ("Bearer") and the token.
+	tokenParts := strings.Split(authHeader, " ")
+
+	// Check that the header is correctly formatted as "Bearer <token>".
+	// If the length isn't 2 or the scheme isn't "Bearer", return an error for invalid format.
+	if len(tokenParts) != 2 || strings.ToLower(tokenParts[0]) != "bearer" {
+		return "", errors.New("invalid Authorization header format")
+	}
+
+	// Return the token (the second part of the split header) and no error.
+	return tokenParts[1], nil
+}
+
+// requestCredential returns the credential of a request: the Bearer token of its Authorization header, or else the
+// token its verified client certificate is mapped to.
+func (s *server) requestCredential(r *http.Request) (credential, error) {
+	if r.Header.Get("Authorization") == "" && s.tls != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		tokenID, ok := s.tls.tokenID(r.TLS.VerifiedChains[0][0].Subject.String())
+		if ok {
+			return credential{tokenID: tokenID}, nil
+		}
+	}
+
+	authToken, err := getHeaderAuthToken(r)
+	if err != nil {
+		return credential{}, err
+	}
+	resolved, _ := r.Context().Value(resolvedTokenIDKey{}).(*string)
+	return credential{secret: authToken, resolved: resolved}, nil
+}
+
+// errKeyForbidden is returned when a token holds a permission on a context, but not on the key asked for.
+var errKeyForbidden = errors.New("key outside of the granted key prefix")
+
+// getKeyPermission checks if a token holds a permission on a key of a context, returning errKeyForbidden when
+// every grant covering the context is limited to keys starting with another prefix.
+func (s *server) getKeyPermission(authToken credential, context string, reqType string, key string) error {
+	grants, err := s.store.getGrants(authToken, context, reqType)
+	if err != nil {
+		return err
+	}
+	if !keyAllowed(grants, key) {
+		return errKeyForbidden
+	}
+	return nil
+}
+
+// permissionStatus returns the status code of a failed permission check: 403 Forbidden when the token can't
+// reach the key, 401 Unauthorized otherwise.
+func permissionStatus(err error) int {
+	if errors.Is(err, errKeyForbidden) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// scopePrefix narrows the key prefix of a listing to the keys grants cover. A request prefix one of the grants
+// covers entirely is kept. Otherwise it is narrowed to the common start of the key prefixes extending it, the keys
+// out of every grant being skipped afterwards, and a request prefix reaching no granted key is forbidden.
+func scopePrefix(prefix string, grants []tokenGrant) (string, error) {
+	if keyAllowed(grants, prefix) {
+		return prefix, nil
+	}
+	narrowed, found := "", false
+	for _, grant := range grants {
+		if !strings.HasPrefix(grant.KeyPrefix, prefix) {
+			continue
+		}
+		if !found {
+			narrowed, found = grant.KeyPrefix, true
+			continue
+		}
+		for !strings.HasPrefix(grant.KeyPrefix, narrowed) {
+			narrowed = narrowed[:len(narrowed)-1]
+		}
+	}
+	if !found {
+		return "", errKeyForbidden
+	}
+	return narrowed, nil
+}
+
+// listAllowedEntries returns up to limit entries like listEntries, skipping the keys out of grants.
+func (s *server) listAllowedEntries(context string, prefix string, after string, limit int, grants []tokenGrant) ([]entry, error) {
+	var list []entry
+	for {
+		page, err := s.store.listEntries(context, prefix, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			if !keyAllowed(grants, e.Key) {
+				continue
+			}
+			list = append(list, e)
+			if len(list) == limit {
+				return list, nil
+			}
+		}
+		if len(page) < limit {
+			return list, nil
+		}
+		after = page[len(page)-1].Key
+	}
+}
+
+// conValueRequest is the body of a key addressed write.
+type conValueRequest struct {
+	value     string
+	expiresAt int64
+	version   int64
+}
+
+// conPrecondition is the version an entry must be at for a write to apply, 0 for any version,
+// and the status answered when it is at another version.
+type conPrecondition struct {
+	version int64
+	status  int
+}
+
+// parseConValueRequest parses the body of a key addressed request, a JSON object holding the value,
+// optionally either a time-to-live in seconds ("ttl") or an absolute RFC 3339 expiry time ("expires_at"),
+// and optionally the version the entry is expected to be at ("version").
+// It is used by the routes that carry the context and the key in the URL path.
+func parseConValueRequest(r *http.Request) (conValueRequest, error) {
+	// Ensure the request body is closed after the function completes.
+	defer r.Body.Close()
+
+	// Decode the JSON body, the value is mandatory.
+	var data struct {
+		Value     *string `json:"value"`
+		TTL       *int64  `json:"ttl"`
+		ExpiresAt *string `json:"expires_at"`
+		Version   *int64  `json:"version"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		return conValueRequest{}, err
+	}
+	if data.Value == nil {
+		return conValueRequest{}, errors.New("key value not defined")
+	}
+	request := conValueRequest{value: *data.Value}
+
+	// The expected version, when defined, is a version an entry can be at.
+	request.version, err = parseVersion(data.Version)
+	if err != nil {
+		return conValueRequest{}, err
+	}
+
+	// Turn the time-to-live or the expiry time into unix milliseconds.
+	request.expiresAt, err = parseExpiry(data.TTL, data.ExpiresAt)
+	if err != nil {
+		return conValueRequest{}, err
+	}
+
+	return request, nil
+}
+
+// parseVersion checks an expected version read from a body, returning 0 when it isn't defined.
+func parseVersion(version *int64) (int64, error) {
+	if version == nil {
+		return 0, nil
+	}
+	if *version < 1 {
+		return 0, errors.New("version must be a positive number")
+	}
+	return *version, nil
+}
+
+// parseExpiry turns either a time-to-live in seconds or an RFC 3339 expiry time read from a body
+// into unix milliseconds, returning 0 when neither is defined.
+func parseExpiry(ttl *int64, expiresAt *string) (int64, error) {
+	switch {
+	case ttl != nil && expiresAt != nil:
+		return 0, errors.New("only one of ttl and expires_at can be defined")
+	case ttl != nil:
+		if *ttl <= 0 {
+			return 0, errors.New("ttl must be a positive number of seconds")
+		}
+		return time.Now().Add(time.Duration(*ttl) * time.Second).UnixMilli(), nil
+	case expiresAt != nil:
+		t, err := time.Parse(time.RFC3339, *expiresAt)
+		if err != nil {
+			return 0, errors.New("expires_at must be an RFC 3339 time")
+		}
+		if !t.After(time.Now()) {
+			return 0, errors.New("expires_at must be in the future")
+		}
+		return t.UnixMilli(), nil
+	}
+	return 0, nil
+}
+
+// parseIfMatch returns the version expected by the If-Match header, the entry ETag, or 0 when any version goes.
+func parseIfMatch(r *http.Request) (int64, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`), 10, 64)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid If-Match header")
+	}
+	return version, nil
+}
+
+// writeVersion adds the version of an entry to a response, both in the body and as the ETag header.
+func writeVersion(w http.ResponseWriter, response map[string]interface{}, version int64) {
+	response["version"] = version
+	w.Header().Set("ETag", `"`+strconv.FormatInt(version, 10)+`"`)
+}
+
+// addExpiry adds the expiry time and the remaining time-to-live in seconds to a response,
+// when the entry expires.
+func addExpiry(response map[string]interface{}, expiresAt int64) {
+	if expiresAt == 0 {
+		return
+	}
+	remaining := time.Until(time.UnixMilli(expiresAt))
+	response["expires_at"] = time.UnixMilli(expiresAt).UTC().Format(time.RFC3339Nano)
+	response["ttl"] = int64(math.Ceil(remaining.Seconds()))
+}
+
+// markDeprecated flags a response of the body based routes, which read the key from the request body.
+// Clients should move to the routes carrying the key in the URL path.
+func markDeprecated(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", "</con/"+r.PathValue("id")+"/{key}>; rel=\"successor-version\"")
+}
+
+// parseConRequest parses an HTTP request and extracts a context, key, and value from the request body.
+// It expects a JSON body with exactly one key-value pair and returns an error if this condition isn't met.
+func parseConRequest(r *http.Request) (string, string, string, error) {
+	// Read the entire body of the request.
+	body, err := io.ReadAll(r.Body)
+
+	// If reading the body fails, return an empty response and the error.
+	if err != nil {
+		return "", "", "", err
+	}
+
+	// Ensure the request body is closed after the function completes.
+	defer r.Body.Close()
+
+	// Create a map to hold the parsed JSON data.
+	var data map[string]interface{}
+
+	// Unmarshal the JSON body into the `data` map.
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return "", "", "", err // Return an error if the JSON parsing fails.
+	}
+
+	// Extract the "id" from the request path as the context (assuming r.PathValue is a valid method).
+	context := r.PathValue("id")
+
+	// Ensure the JSON body contains exactly one key-value pair.
+	if len(data) == 1 {
+		// Since Go maps do not have a direct way to access the first element, we manually iterate over the map.
+		for key, value := range data {
+
+			// Type assert the value to a string. If the value is not a string, return an error.
+			valueStr, ok := value.(string)
+			if !ok {
+				return "", "", "", errors.New("value is not a string") // Handle the case where the value isn't a string.
+			}
+
+			// If everything is successful, return the context (id), the key, and the string value.
+			return context, key, valueStr, nil
+		}
+	}
+	
+	// Return an error if the JSON body does not contain exactly one key-value pair.
+	return "", "", "", errors.New("JSON body must have 1 key-value pair")
+}
+
+// conPost handles the deprecated HTTP POST requests creating an entry from a single key-value pair in the body.
+func (s *server) conPost(w http.ResponseWriter, r *http.Request) {
+	markDeprecated(w, r)
+
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	// If the token is missing or invalid, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the context, key, and value from the request body.
+	context, key, value, err := parseConRequest(r)
+	// If the request body is invalid or improperly formatted, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.createConEntry(w, authToken, context, key, value, 0)
+}
+
+// conKeyPost handles HTTP POST requests to /con/{id}/{key} creating the entry with the value from the body.
+func (s *server) conKeyPost(w http.ResponseWriter, r *http.Request) {
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	// If the token is missing or invalid, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the value and its expiry from the request body.
+	request, err := parseConValueRequest(r)
+	// If the request body is invalid or improperly formatted, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.createConEntry(w, authToken, r.PathValue("id"), r.PathValue("key"), request.value, request.expiresAt)
+}
+
+// createConEntry checks permissions and then inserts the entry into the database, expiring at expiresAt.
+func (s *server) createConEntry(w http.ResponseWriter, authToken credential, context string, key string, value string, expiresAt int64) {
+	// Tell the audit log which entry the action is about.
+	noteAudit(w, context, key, value)
+
+	// Keys named like the endpoints of the context can't be created, they couldn't be addressed by path.
+	err := validateNewKey(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Verify that the authenticated user has permission to perform the POST operation in the given context.
+	err = s.getKeyPermission(authToken, context, "POST", key)
+	// If the user lacks the necessary permissions, return a 401 Unauthorized error, or a 403 Forbidden
+	// error when only the key is out of reach.
+	if err != nil {
+		http.Error(w, err.Error(), permissionStatus(err))
+		return
+	}
+
+	// Retrieve and verify the actual context from the database (e.g., normalizing or ensuring its existence).
+	context, err = s.store.getContext(context)
+	// If the context is invalid or not found, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Create a new entry in the database using the context, key, and value.
+	err = s.store.createEntry(context, key, value, expiresAt)
+	// If the entry creation fails, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	successResponse := map[string]interface{}{
+		"key":key,
+		"value":value,
+		"context":context,
+		"status":"created",
+	}
+	addExpiry(successResponse, expiresAt)
+	writeVersion(w, successResponse, 1)
+
+	// Set the response header to JSON and respond with the success response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(successResponse)
+
+}
+
+// conPut handles the deprecated HTTP PUT requests updating an entry from a single key-value pair in the body.
+func (s *server) conPut(w http.ResponseWriter, r *http.Request) {
+	markDeprecated(w, r)
+
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	// If the token is missing or invalid, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the context, key, and value from the request body.
+	context, key, value, err := parseConRequest(r)
+	// If the request body is invalid or improperly formatted, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.updateConEntry(w, authToken, context, key, value, 0, conPrecondition{})
+}
+
+// conKeyPut handles HTTP PUT requests to /con/{id}/{key} updating the entry with the value from the body.
+func (s *server) conKeyPut(w http.ResponseWriter, r *http.Request) {
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	// If the token is missing or invalid, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the value and its expiry from the request body.
+	request, err := parseConValueRequest(r)
+	// If the request body is invalid or improperly formatted, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The expected version comes either from the body or from the If-Match header, which answer differently.
+	precondition := conPrecondition{version: request.version, status: http.StatusConflict}
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ifMatch != 0 {
+		if request.version != 0 {
+			http.Error(w, "only one of version and If-Match can be defined", http.StatusBadRequest)
+			return
+		}
+		precondition = conPrecondition{version: ifMatch, status: http.StatusPreconditionFailed}
+	}
+
+	s.updateConEntry(w, authToken, r.PathValue("id"), r.PathValue("key"), request.value, request.expiresAt, precondition)
+}
+
+// updateConEntry checks permissions and then updates an existing entry in the database, provided it is at the
+// version expected by the precondition. The entry then expires at expiresAt, or never when it is 0.
+func (s *server) updateConEntry(w http.ResponseWriter, authToken credential, context string, key string, value string, expiresAt int64, precondition conPrecondition) {
+	// Tell the audit log which entry the action is about.
+	noteAudit(w, context, key, value)
+
+	// Verify that the authenticated user has permission to perform the PUT operation in the given context.
+	err := s.getKeyPermission(authToken, context, "PUT", key)
+	// If the user lacks the necessary permissions, return a 401 Unauthorized error, or a 403 Forbidden
+	// error when only the key is out of reach.
+	if err != nil {
+		http.Error(w, err.Error(), permissionStatus(err))
+		return
+	}
+
+	// Retrieve and verify the actual context from the database.
+	_, err = s.store.getContext(context)
+	// If the context is invalid or not found, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Update the existing entry in the database using the context, key, and value.
+	version, err := s.store.updateEntry(context, key, value, expiresAt, precondition.version)
+	// If the entry is at another version than expected, answer with the precondition status.
+	if errors.Is(err, errVersionMismatch) {
+		http.Error(w, err.Error(), precondition.status)
+		return
+	}
+	// If the entry update fails, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	successResponse := map[string]interface{}{
+		"key":key,
+		"value":value,
+		"context":context,
+		"status":"updated",
+	}
+	addExpiry(successResponse, expiresAt)
+	writeVersion(w, successResponse, version)
+
+	// Set the response header to JSON and respond with the success response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(successResponse)
+
+}
+
+// conGet handles GET requests on a context. With listing parameters, or without a body, they list the context,
+// otherwise they are the deprecated lookups reading the key of the entry from the request body.
+func (s *server) conGet(w http.ResponseWriter, r *http.Request) {
+	// A request carrying listing parameters, or no body at all, is a listing. Other parameters, like cache
+	// busters, don't turn a lookup into a listing.
+	if slices.ContainsFunc(conListParameters, r.URL.Query().Has) || r.Body == http.NoBody {
+		s.conList(w, r)
+		return
+	}
+
+	markDeprecated(w, r)
+
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		// If there's an error, respond with an unauthorized status.
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the request to get the context and the key, sent as the value of the pair.
+	context, _, key, err := parseConRequest(r)
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.readConEntry(w, authToken, context, key)
+}
+
+// conList handles GET requests to /con/{id}?prefix=&limit=&cursor=&values= listing the keys of a context.
+// Keys come in lexical order, and when more keys are left the response carries an opaque cursor to continue from.
+func (s *server) conList(w http.ResponseWriter, r *http.Request) {
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		// If there's an error, respond with an unauthorized status.
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Get the context ID from the request path.
+	context := r.PathValue("id")
+
+	// Parse the listing options from the query string.
+	prefix, after, limit, withValues, err := parseConListRequest(r)
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check if the user has permission to perform the GET operation.
+	grants, err := s.store.getGrants(authToken, context, "GET")
+	if err != nil {
+		// If there's an error, respond with an unauthorized status.
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Only list the keys the grants cover.
+	prefix, err = scopePrefix(prefix, grants)
+	if err != nil {
+		// If the prefix reaches keys out of the grant, respond with a forbidden status.
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Retrieve the context from the database.
+	_, err = s.store.getContext(context)
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fetch one entry more than asked to know whether the listing continues.
+	list, err := s.listAllowedEntries(context, prefix, after, limit+1, grants)
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	successResponse := map[string]interface{}{
+		"context": context,
+	}
+
+	// When there are more entries, the cursor is the last key returned.
+	if len(list) > limit {
+		list = list[:limit]
+		successResponse["next_cursor"] = base64.RawURLEncoding.EncodeToString([]byte(list[limit-1].Key))
+	}
+
+	entries := make([]map[string]interface{}, 0, len(list))
+	for _, e := range list {
+		item := map[string]interface{}{"key": e.Key}
+		if withValues {
+			item["value"] = e.Value
+			item["version"] = e.Version
+		}
+		entries = append(entries, item)
+	}
+	successResponse["entries"] = entries
+
+	// Set the response header to JSON and respond with the success response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(successResponse)
+}
+
+// parseConListRequest parses the query string of a listing: the key prefix, the cursor decoded as the key
+// to continue after, the page size and whether values are returned along with the keys.
+func parseConListRequest(r *http.Request) (string, string, int, bool, error) {
+	query := r.URL.Query()
+
+	// The page size defaults to conListDefaultLimit and can't go over conListMaxLimit.
+	limit := conListDefaultLimit
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > conListMaxLimit {
+			return "", "", 0, false, fmt.Errorf("limit must be a number between 1 and %d", conListMaxLimit)
+		}
+	}
+
+	// The cursor is opaque to clients, it holds the last key of the previous page.
+	after, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+	if err != nil {
+		return "", "", 0, false, errors.New("invalid cursor")
+	}
+
+	// Values are only returned when asked for.
+	withValues := false
+	if query.Has("values") {
+		withValues, err = strconv.ParseBool(query.Get("values"))
+		if err != nil {
+			return "", "", 0, false, errors.New("values must be true or false")
+		}
+	}
+
+	return query.Get("prefix"), string(after), limit, withValues, nil
+}
+
+// conKeyGet handles GET requests to /con/{id}/{key} retrieving a specific entry.
+func (s *server) conKeyGet(w http.ResponseWriter, r *http.Request) {
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		// If there's an error, respond with an unauthorized status.
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	s.readConEntry(w, authToken, r.PathValue("id"), r.PathValue("key"))
+}
+
+// readConEntry checks permissions and then retrieves a specific entry.
+func (s *server) readConEntry(w http.ResponseWriter, authToken credential, context string, key string) {
+	// Tell the audit log which entry the action is about.
+	noteAudit(w, context, key, "")
+
+	// Check if the user has permission to perform the GET operation.
+	err := s.getKeyPermission(authToken, context, "GET", key)
+	if err != nil {
+		// If there's an error, respond with an unauthorized status, or a forbidden one for a key out of reach.
+		http.Error(w, err.Error(), permissionStatus(err))
+		return
+	}
+
+	// Retrieve the context from the database.
+	_, err = s.store.getContext(context)
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Retrieve the entry from the database.
+	e, err := s.store.getEntry(context, key)
+	if err != nil {
+		// If there's an error, respond with a not found status.
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	// Create a response map with the retrieved key-value pair and its remaining time-to-live.
+	successResponse := map[string]interface{}{
+		"key":key,
+		"value":e.Value,
+		"context":context,
+	}
+	addExpiry(successResponse, e.ExpiresAt)
+	writeVersion(w, successResponse, e.Version)
+
+	// Set the response header to JSON and respond with the success response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(successResponse)
+}
+
+// conDelete handles the deprecated DELETE requests reading the key of the entry from the request body.
+func (s *server) conDelete(w http.ResponseWriter, r *http.Request) {
+	markDeprecated(w, r)
+
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		// If there's an error, respond with an unauthorized status.
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the request to get the context and the key, sent as the value of the pair.
+	context, _, key, err := parseConRequest(r)
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The body based route has always needed the PUT permission, DELETE is accepted too.
+	s.removeConEntry(w, authToken, context, key, conPrecondition{}, "DELETE", "PUT")
+}
+
+// conKeyDelete handles DELETE requests to /con/{id}/{key} removing a specific entry.
+func (s *server) conKeyDelete(w http.ResponseWriter, r *http.Request) {
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	if err != nil {
+		// If there's an error, respond with an unauthorized status.
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The entry can be expected at a version with the If-Match header.
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.removeConEntry(w, authToken, r.PathValue("id"), r.PathValue("key"), conPrecondition{version: ifMatch, status: http.StatusPreconditionFailed}, "DELETE")
+}
+
+// removeConEntry checks that the token holds one of the permissions and then removes a specific entry,
+// provided it is at the version expected by the precondition.
+func (s *server) removeConEntry(w http.ResponseWriter, authToken credential, context string, key string, precondition conPrecondition, permissions ...string) {
+	// Tell the audit log which entry the action is about.
+	noteAudit(w, context, key, "")
+
+	// Check if the user has one of the permissions to perform the DELETE operation.
+	var err error
+	for _, permission := range permissions {
+		err = s.getKeyPermission(authToken, context, permission, key)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		// If there's an error, respond with an unauthorized status, or a forbidden one for a key out of reach.
+		http.Error(w, err.Error(), permissionStatus(err))
+		return
+	}
+
+	// Retrieve the context from the database.
+	_, err = s.store.getContext(context)
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Delete the entry from the database.
+	err = s.store.deleteEntry(context, key, precondition.version)
+	if errors.Is(err, errVersionMismatch) {
+		// If the entry is at another version than expected, answer with the precondition status.
+		http.Error(w, err.Error(), precondition.status)
+		return
+	}
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Set the response header to JSON and respond with a success status.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// conBatch handles POST requests to /con/{id}/_batch applying several operations on the entries of a context
+// at once. Either every operation applies or none does.
+func (s *server) conBatch(w http.ResponseWriter, r *http.Request) {
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	// If the token is missing or invalid, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Get the context ID from the request path.
+	context := r.PathValue("id")
+
+	// Parse the operations from the request body.
+	ops, err := parseConBatchRequest(r)
+	// If the request body is invalid or improperly formatted, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Tell the audit log which keys the batch is about.
+	keys := make([]string, 0, len(ops))
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	noteAuditKeys(w, keys)
+
+	// Every kind of operation in the batch needs its own permission, each one is checked once.
+	grantsByVerb := map[string][]tokenGrant{}
+	for _, op := range ops {
+		verb := conBatchVerbs[op.Op]
+		grants, checked := grantsByVerb[verb]
+		if !checked {
+			grants, err = s.store.getGrants(authToken, context, verb)
+			// If the user lacks one of the permissions, return a 401 Unauthorized error.
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			grantsByVerb[verb] = grants
+		}
+		// If the key of an operation is out of reach, return a 403 Forbidden error.
+		if !keyAllowed(grants, op.Key) {
+			http.Error(w, errKeyForbidden.Error()+": "+op.Key, http.StatusForbidden)
+			return
+		}
+	}
+
+	// Retrieve and verify the actual context from the database.
+	_, err = s.store.getContext(context)
+	// If the context is invalid or not found, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Apply the whole batch, the error tells which operation failed.
+	results, err := s.store.applyBatch(context, ops)
+	// If an entry is at another version than expected, return a 409 Conflict error.
+	if errors.Is(err, errVersionMismatch) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	// If any other operation fails, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		item := map[string]interface{}{
+			"op":  result.Op,
+			"key": result.Key,
+		}
+		switch {
+		case result.Op == batchCreate:
+			item["status"] = "created"
+		case result.Op == batchUpdate:
+			item["status"] = "updated"
+		case result.Op == batchDelete:
+			item["status"] = "deleted"
+		case result.Found:
+			item["status"] = "found"
+		default:
+			item["status"] = "not found"
+		}
+		// Deleted and missing entries have nothing more to show.
+		if result.Op == batchCreate || result.Op == batchUpdate || result.Op == batchGet && result.Found {
+			item["value"] = result.Entry.Value
+			item["version"] = result.Entry.Version
+			addExpiry(item, result.Entry.ExpiresAt)
+		}
+		items = append(items, item)
+	}
+
+	successResponse := map[string]interface{}{
+		"context": context,
+		"results": items,
+	}
+
+	// Set the response header to JSON and respond with the success response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(successResponse)
+}
+
+// parseConBatchRequest parses the body of a batch, a JSON object holding the list of operations to apply in order.
+// Each operation names its kind ("op") and its key, create and update operations a value and optionally an expiry
+// like a key addressed write, and every operation but create optionally the version the entry must be at.
+func parseConBatchRequest(r *http.Request) ([]batchOp, error) {
+	// Ensure the request body is closed after the function completes.
+	defer r.Body.Close()
+
+	var data struct {
+		Operations []struct {
+			Op        string  `json:"op"`
+			Key       *string `json:"key"`
+			Value     *string `json:"value"`
+			TTL       *int64  `json:"ttl"`
+			ExpiresAt *string `json:"expires_at"`
+			Version   *int64  `json:"version"`
+		} `json:"operations"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Operations) == 0 {
+		return nil, errors.New("batch has no operations")
+	}
+	if len(data.Operations) > conBatchMaxOperations {
+		return nil, fmt.Errorf("batch can't hold more than %d operations", conBatchMaxOperations)
+	}
+
+	ops := make([]batchOp, 0, len(data.Operations))
+	for i, item := range data.Operations {
+		// Errors name the operation they come from.
+		fail := func(err error) ([]batchOp, error) {
+			return nil, &batchError{index: i, err: err}
+		}
+
+		if _, ok := conBatchVerbs[item.Op]; !ok {
+			return fail(errors.New("op must be one of create, update, delete and get"))
+		}
+		if item.Key == nil || *item.Key == "" {
+			return fail(errors.New("key not defined"))
+		}
+		if item.Op == batchCreate {
+			if err := validateNewKey(*item.Key); err != nil {
+				return fail(err)
+			}
+		}
+		op := batchOp{Op: item.Op, Key: *item.Key}
+
+		// Only writes carry a value and an expiry.
+		writes := item.Op == batchCreate || item.Op == batchUpdate
+		if writes && item.Value == nil {
+			return fail(errors.New("key value not defined"))
+		}
+		if !writes && (item.Value != nil || item.TTL != nil || item.ExpiresAt != nil) {
+			return fail(errors.New("only create and update can define a value or an expiry"))
+		}
+		if item.Value != nil {
+			op.Value = *item.Value
+		}
+		op.ExpiresAt, err = parseExpiry(item.TTL, item.ExpiresAt)
+		if err != nil {
+			return fail(err)
+		}
+
+		// A new entry has no version to expect yet.
+		if item.Op == batchCreate && item.Version != nil {
+			return fail(errors.New("create can't define a version"))
+		}
+		op.Version, err = parseVersion(item.Version)
+		if err != nil {
+			return fail(err)
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+// conMultiGet handles POST requests to /con/{id}/_mget retrieving several entries of a context at once.
+// The entries come back in the order of the requested keys, along with the list of the keys that were not found.
+func (s *server) conMultiGet(w http.ResponseWriter, r *http.Request) {
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	// If the token is missing or invalid, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Get the context ID from the request path.
+	context := r.PathValue("id")
+
+	// Parse the keys from the request body.
+	keys, err := parseConMultiGetRequest(r)
+	// If the request body is invalid or improperly formatted, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Tell the audit log which keys are read.
+	noteAuditKeys(w, keys)
+
+	// A single GET permission check covers every key.
+	grants, err := s.store.getGrants(authToken, context, "GET")
+	// If the user lacks the necessary permissions, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	// If any key is out of reach, return a 403 Forbidden error.
+	for _, key := range keys {
+		if !keyAllowed(grants, key) {
+			http.Error(w, errKeyForbidden.Error()+": "+key, http.StatusForbidden)
+			return
+		}
+	}
+
+	// Retrieve and verify the actual context from the database.
+	_, err = s.store.getContext(context)
+	// If the context is invalid or not found, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fetch every entry at once.
+	found, err := s.store.getEntries(context, keys)
+	if err != nil {
+		// If there's an error, respond with a bad request status.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Answer in the order of the request, so results can be matched with the keys by position.
+	entries := make([]map[string]interface{}, 0, len(keys))
+	missing := make([]string, 0)
+	for _, key := range keys {
+		e, ok := found[key]
+		item := map[string]interface{}{
+			"key":   key,
+			"found": ok,
+		}
+		if ok {
+			item["value"] = e.Value
+			item["version"] = e.Version
+			addExpiry(item, e.ExpiresAt)
+		} else {
+			missing = append(missing, key)
+		}
+		entries = append(entries, item)
+	}
+
+	successResponse := map[string]interface{}{
+		"context": context,
+		"entries": entries,
+		"missing": missing,
+	}
+
+	// Set the response header to JSON and respond with the success response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(successResponse)
+}
+
+// parseConMultiGetRequest parses the body of a multi-get, a JSON object holding the list of keys to retrieve.
+func parseConMultiGetRequest(r *http.Request) ([]string, error) {
+	// Ensure the request body is closed after the function completes.
+	defer r.Body.Close()
+
+	var data struct {
+		Keys []string `json:"keys"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Keys) == 0 {
+		return nil, errors.New("keys not defined")
+	}
+	if len(data.Keys) > conMultiGetMaxKeys {
+		return nil, fmt.Errorf("can't get more than %d keys at once", conMultiGetMaxKeys)
+	}
+	for _, key := range data.Keys {
+		if key == "" {
+			return nil, errors.New("keys can't be empty")
+		}
+	}
+
+	return data.Keys, nil
+}
+
+// conListParameters are the query parameters of a listing.
+var conListParameters = []string{"prefix", "limit", "cursor", "values"}
+
+// conWatchKeepAlive is how often an idle watch stream sends a comment, so proxies don't close it.
+const conWatchKeepAlive = 15 * time.Second
+
+// conWatch handles GET requests to /con/{id}/_watch streaming the changes to the entries of a context
+// as Server-Sent Events, optionally only those whose key starts with the prefix query parameter.
+// A client reconnecting with the Last-Event-ID header, or the last_event_id query parameter, first gets
+// the changes it missed. The grants are checked again before every event and keep-alive, and the stream
+// ends with an error event once they no longer let the token watch.
+func (s *server) conWatch(w http.ResponseWriter, r *http.Request) {
+	// Extract the authorization token from the request header.
+	authToken, err := s.requestCredential(r)
+	// If the token is missing or invalid, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Get the context ID from the request path.
+	context := r.PathValue("id")
+
+	// Parse the event to resume from, if any.
+	lastID, resume, err := parseConWatchRequest(r)
+	// If the event ID is invalid, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Watching needs the same permission as reading.
+	grants, err := s.store.getGrants(authToken, context, "GET")
+	// If the user lacks the necessary permissions, return a 401 Unauthorized error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Only watch the keys the grants cover.
+	prefix, err := scopePrefix(r.URL.Query().Get("prefix"), grants)
+	// If the prefix reaches keys out of the grant, return a 403 Forbidden error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Retrieve and verify the actual context from the database.
+	_, err = s.store.getContext(context)
+	// If the context is invalid or not found, return a 400 Bad Request error.
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Events are written as they come, which needs a flushable response.
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before answering, so no change committed from now on is missed.
+	watcher, backlog, err := s.changes.subscribe(context, prefix, lastID, resume)
+	// If the missed changes are no longer known, return a 410 Gone error.
+	if errors.Is(err, errHistoryLost) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	defer s.changes.unsubscribe(watcher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for _, event := range backlog {
+		if keyAllowed(grants, event.Key) {
+			writeConEvent(w, event)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(conWatchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.events:
+			// The stream is closed when the client fell too far behind, it can reconnect and resume.
+			if !ok {
+				return
+			}
+			// The token may have been revoked, deleted, rotated or have expired since the last event.
+			grants, err = s.store.getGrants(authToken, context, "GET")
+			if err != nil {
+				writeConError(w, flusher, err)
+				return
+			}
+			if !keyAllowed(grants, event.Key) {
+				continue
+			}
+			writeConEvent(w, event)
+		case <-keepAlive.C:
+			grants, err = s.store.getGrants(authToken, context, "GET")
+			if err != nil {
+				writeConError(w, flusher, err)
+				return
+			}
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		// The server shuts down, the client can reconnect and resume on the next one.
+		case <-s.shutdown:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// parseConWatchRequest returns the ID of the last event seen by a reconnecting watcher and whether there is one.
+func parseConWatchRequest(r *http.Request) (uint64, bool, error) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID == "" {
+		return 0, false, nil
+	}
+	lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return 0, false, errors.New("invalid last event ID")
+	}
+	return lastID, true, nil
+}
+
+// writeConError ends a watch stream with an error event, its data being the reason.
+func writeConError(w http.ResponseWriter, flusher http.Flusher, err error) {
+	payload, _ := json.Marshal(map[string]string{"error": err.Error()})
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", payload)
+	flusher.Flush()
+}
+
+// writeConEvent writes a change as a Server-Sent Event named after the kind of change, its data being the entry.
+func writeConEvent(w http.ResponseWriter, event changeEvent) {
+	data := map[string]interface{}{
+		"context": event.Context,
+		"key":     event.Key,
+	}
+	if event.Op == changeCreate || event.Op == changeUpdate {
+		data["value"] = event.Value
+		data["version"] = event.Version
+		addExpiry(data, event.ExpiresAt)
+	}
+	payload, _ := json.Marshal(data)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Op, payload)
+}
@@ -1,424 +1,1470 @@
-package main
-
-import (
-	"database/sql"
-	"errors"
-	"fmt"
-	"log"
-
-	"github.com/google/uuid"
-	_ "github.com/mattn/go-sqlite3"
-)
-
-// connectSQLite establishes a connection to the SQLite database.
-func connectSQLite() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./db.sqlite3")
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
-}
-
-// createContextDataTable creates a table for storing key-value pairs in a specific context.
-func createContextDataTable(db *sql.DB, context string) error {
-	logStuff("creating context " + context + " table.")
-	createTableSQL := "CREATE TABLE IF NOT EXISTS " + context + " (key TEXT UNIQUE,value TEXT);"
-
-	_, err := db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return nil
-}
-
-// deleteContextDataTable deletes a table for a specific context.
-func deleteContextDataTable(db *sql.DB, context string) error {
-	logStuff("deleting context " + context + " table.")
-	createTableSQL := "DROP TABLE " + context + ";"
-
-	_, err := db.Exec(createTableSQL, context)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return nil
-}
-
-// createContextTable creates a table to store context names.
-func createContextTable(db *sql.DB) {
-	logStuff("creating context table")
-	createTableSQL := `CREATE TABLE IF NOT EXISTS context (
-		name TEXT UNIQUE
-	);`
-
-	_, err := db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	fmt.Println("Table context created successfully!")
-}
-
-// createTokenTable creates a table to store tokens.
-func createTokenTable(db *sql.DB) {
-	logStuff("create token table")
-	createTableSQL := `CREATE TABLE IF NOT EXISTS token (
-		token TEXT UNIQUE
-	);`
-
-	_, err := db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	fmt.Println("Table token created successfully!")
-}
-
-// createPermissionTable creates a table to store permissions associated with tokens and contexts.
-func createPermissionTable(db *sql.DB) {
-	logStuff("create permission table")
-	createTableSQL := `CREATE TABLE IF NOT EXISTS permission (
-		token TEXT,
-		permission TEXT,
-		context TEXT,
-		UNIQUE (token, permission, context)
-	);`
-
-	_, err := db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	fmt.Println("Table permission created successfully!")
-}
-
-// createEntry inserts a key-value pair into a specific context table.
-func createEntry(db *sql.DB, context string, key string, value string) (string, string, string, error) {
-	insertEntrySQL := "INSERT INTO " + context + ` (key, value) VALUES (?, ?)`
-	_, err := db.Exec(insertEntrySQL, key, value)
-	if err != nil {
-		logStuff("error on creating entry {" + key + ":" + value + "} on context: " + context)
-		logStuff(err.Error())
-		return "", "", "", err
-	}
-	logStuff("creating entry {" + key + ":" + value + "} on context: " + context)
-	return context, key, value, nil
-}
-
-// getEntry retrieves the value for a specific key from a context table.
-func getEntry(db *sql.DB, context string, key string) (string, string, string, error) {
-	logStuff("Searching for key " + key + " on context " + context)
-	rows, err := db.Query("SELECT value FROM " + context + " WHERE key = '" + key + "';")
-	if err != nil {
-		logStuff("error " + err.Error())
-		return "", "", "", err
-	}
-	defer rows.Close()
-	var value string
-	var found bool
-	for rows.Next() {
-		err := rows.Scan(&value)
-		if err != nil {
-			logStuff("no entry found for key " + key + " con context " + context)
-			return "", "", "", err
-		}
-		found = true
-	}
-
-	if !found {
-		logStuff("error on returning entry " + key + " from context " + context)
-		return "", "", "", fmt.Errorf("no entry found for key: %s in context: %s", key, context)
-	}
-
-	logStuff("returning entry " + key + " from context " + context)
-	return context, key, value, nil
-}
-
-// updateEntry updates the value for a specific key in a context table.
-func updateEntry(db *sql.DB, context string, key string, value string) (string, string, string, error) {
-	updateEntrySQL := "UPDATE " + context + ` SET value = ? WHERE key = ?`
-	result, err := db.Exec(updateEntrySQL, value, key)
-	if err != nil {
-		return "", "", "", err
-	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		logStuff("error on updating entry " + key + " with value " + value + " on context :" + context)
-		return "", "", "", errors.New("key-value pair doesn't exists")
-	}
-	logStuff("updating entry " + key + " with value " + value + " on context :" + context)
-	return context, key, value, nil
-}
-
-// deleteEntry deletes a key-value pair from a context table.
-func deleteEntry(db *sql.DB, context string, key string) error {
-	deleteEntrySQL := "DELETE FROM " + context + ` WHERE key = ?`
-	result, err := db.Exec(deleteEntrySQL, key)
-	if err != nil {
-		logStuff("error on deleting entry " + key + " from context " + context)
-		return err
-	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		logStuff("error on deleting entry " + key + " from context " + context)
-		return errors.New("key-value pair doesn't exists")
-	}
-	logStuff("deleting entry " + key + " from context " + context)
-	return nil
-}
-
-// createContext inserts a new context name into the context table.
-func createContext(db *sql.DB, name string) (string, error) {
-	insertContextSQL := `INSERT INTO context (name) VALUES (?)`
-	_, err := db.Exec(insertContextSQL, name)
-	if err != nil {
-		logStuff("error on creating context " + name)
-		return "", err
-	}
-	logStuff("creating context " + name)
-	return name, nil
-}
-
-// getContext retrieves a context name from the context table.
-func getContext(db *sql.DB, name string) (string, error) {
-	rows, err := db.Query("SELECT name FROM context WHERE name = ?", name)
-	if err != nil {
-		logStuff("error on returning context " + name)
-		return "", err
-	}
-	defer rows.Close()
-
-	var value string
-	var found bool
-	for rows.Next() {
-		err := rows.Scan(&value)
-		if err != nil {
-			return "", err
-		}
-		found = true
-	}
-
-	if !found {
-		logStuff("error on returning context " + name)
-		return "", fmt.Errorf("no context : %s", name)
-	}
-
-	logStuff("returning context " + name)
-	return value, nil
-}
-
-// deleteContext deletes a context name from the context table.
-func deleteContext(db *sql.DB, name string) error {
-	deleteContextSQL := `DELETE FROM context WHERE name = ?`
-	result, err := db.Exec(deleteContextSQL, name)
-	if err != nil {
-		logStuff("error on deleting context " + name)
-		return err
-	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		logStuff("error on deleting context " + name)
-		return errors.New("context doesn't exists")
-	}
-	logStuff("deleting context " + name)
-	return nil
-}
-
-// createToken generates a new token and inserts it into the token table.
-func createToken(db *sql.DB) (string, error) {
-	newUUID := uuid.New().String()
-	tokenSha := tokenToSha256(newUUID)
-	insertTokenSQL := `INSERT INTO token (token) VALUES (?)`
-	_, err := db.Exec(insertTokenSQL, tokenSha)
-	if err != nil {
-		logStuff("error on creating token")
-		return "", err
-	}
-	logStuff("creating token")
-	return newUUID, nil
-}
-
-// getPermission checks if a token has a specific permission in a context.
-func getPermission(db *sql.DB, token string, context string, reqType string) error {
-	tokenSha := tokenToSha256(token)
-
-	rows, err := db.Query(
-		"SELECT token FROM permission WHERE token = ? AND context = ? AND permission = ?;",
-		tokenSha, context, reqType)
-	if err != nil {
-		logStuff("error on checking permission for context " + context)
-		return err
-	}
-	defer rows.Close()
-
-	var found bool
-	for rows.Next() {
-		found = true
-	}
-
-	if !found {
-		logStuff("error on checking permission for context " + context)
-		return errors.New("not authorized")
-	}
-	logStuff("checking permission for context " + context)
-	return nil
-}
-
-// deleteToken deletes a token and its associated permissions from the database.
-func deleteToken(db *sql.DB, token string) error {
-    // Convert the token to its SHA-256 hash.
-    tokenSha := tokenToSha256(token)
-
-    // SQL query to delete permissions associated with the token.
-    deleteTokenPermissionsSQL := `DELETE FROM permission WHERE token = ?`
-    _, err := db.Exec(deleteTokenPermissionsSQL, tokenSha)
-    if err != nil {
-        return err
-    }
-
-    // SQL query to delete the token itself.
-    var result sql.Result
-    deleteTokenSQL := `DELETE FROM token WHERE token = ?`
-    result, err = db.Exec(deleteTokenSQL, tokenSha)
-    if err != nil {
-        logStuff("error on deleting token")
-        return err
-    }
-
-    // Check if any rows were affected by the delete operation.
-    rowsAffected, _ := result.RowsAffected()
-    if rowsAffected == 0 {
-        logStuff("error on deleting token")
-        return errors.New("token doesn't exist")
-    }
-
-    logStuff("deleting token")
-    return nil
-}
-
-// grantTokenPermission grants a specific permission to a token within a given context.
-func grantTokenPermission(db *sql.DB, token string, permission string, context string) (string, string, string, error) {
-    // Convert the token to its SHA-256 hash.
-    tokenSha := tokenToSha256(token)
-
-    // SQL query to insert the new permission.
-    insertPermissionSQL := `INSERT INTO permission (token, permission, context) VALUES (?, ?, ?)`
-    _, err := db.Exec(insertPermissionSQL, tokenSha, permission, context)
-    if err != nil {
-        logStuff("error on granting permission on context " + context + " for token")
-        return "", "", "", err
-    }
-    logStuff("granting permission on context " + context + " for token")
-    return token, permission, context, nil
-}
-
-// rovokeTokenPermission revokes a specific permission from a token within a given context.
-func rovokeTokenPermission(db *sql.DB, token string, permission string, context string) error {
-    // Convert the token to its SHA-256 hash.
-    tokenSha := tokenToSha256(token)
-
-    // SQL query to delete the permission.
-    deletePermissionSQL := `DELETE FROM permission WHERE token = ? AND permission = ? AND context = ?`
-    _, err := db.Exec(deletePermissionSQL, tokenSha, permission, context)
-    if err != nil {
-        logStuff("error on revoking permission of a token from the context " + context)
-        return err
-    }
-
-    logStuff("revoking permission of a token from the context " + context)
-    return nil
-}
-
-// createAdmToken creates an admin token with all necessary permissions if it doesn't already exist.
-func createAdmToken(db *sql.DB) (string, error) {
-    // Check if an admin token already exists.
-    _, found, _ := admTokenExists(db)
-
-    if !found {
-        // Create a new token.
-        token, err := createToken(db)
-        if err != nil {
-            return "", err
-        }
-        // Grant all necessary permissions to the new admin token.
-        _, _, _, err = grantTokenPermission(db, token, "ADM_TOKEN_POST", "ALL")
-        if err != nil {
-            return "", err
-        }
-        _, _, _, err = grantTokenPermission(db, token, "ADM_TOKEN_DELETE", "ALL")
-        if err != nil {
-            return "", err
-        }
-        _, _, _, err = grantTokenPermission(db, token, "ADM_TOKEN_GRANT", "ALL")
-        if err != nil {
-            return "", err
-        }
-        _, _, _, err = grantTokenPermission(db, token, "ADM_TOKEN_REVOKE", "ALL")
-        if err != nil {
-            return "", err
-        }
-        _, _, _, err = grantTokenPermission(db, token, "ADM_CONTEXT_POST", "ALL")
-        if err != nil {
-            return "", err
-        }
-        _, _, _, err = grantTokenPermission(db, token, "ADM_CONTEXT_GET", "ALL")
-        if err != nil {
-            return "", err
-        }
-        _, _, _, err = grantTokenPermission(db, token, "ADM_CONTEXT_DELETE", "ALL")
-        if err != nil {
-            return "", err
-        }
-        return token, err
-    }
-    return "", nil
-}
-
-// admTokenExists checks if an admin token already exists in the database.
-func admTokenExists(db *sql.DB) (string, bool, error) {
-    // SQL query to find any admin tokens.
-    rows, err := db.Query("SELECT token FROM permission WHERE permission like 'ADM_TOKEN%'")
-    if err != nil {
-        return "", false, err
-    }
-    defer rows.Close()
-    var value string
-    var found bool
-    for rows.Next() {
-        err := rows.Scan(&value)
-        if err != nil {
-            return "", false, err
-        }
-        found = true
-    }
-    if !found {
-        return "", false, errors.New("adm token does not exist")
-    }
-    return value, found, nil
-}
-
-// getToken checks if a token exists in the database.
-func getToken(db *sql.DB, token string) error {
-    // Convert the token to its SHA-256 hash.
-    tokenSha := tokenToSha256(token)
-
-    // SQL query to check if the token exists.
-    rows, err := db.Query("SELECT token FROM token WHERE token = ? ", tokenSha)
-    if err != nil {
-        logStuff("error on checking if token exists")
-        return err
-    }
-    defer rows.Close()
-
-    var found bool
-    for rows.Next() {
-        found = true
-    }
-
-    if !found {
-        logStuff("error on checking if token exists")
-        return errors.New("token does not exist")
-    }
-
-    logStuff("checking if token exists")
-    return nil
-}
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dbExecutor is what the entry functions need to run their statements, so they work
+// the same on the database and inside a transaction.
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// connectSQLite opens the pool of connections to the SQLite database at path, shared by every request.
+// Transactions take the write lock when they begin, so two batches never deadlock upgrading their locks.
+// The database is in WAL journal mode so readers don't block the writer, and a connection finding it locked
+// waits up to busyTimeout before failing with "database is locked".
+func connectSQLite(path string, busyTimeout time.Duration, maxConns int) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s?_txlock=immediate&_journal_mode=WAL&_busy_timeout=%d", path, busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Idle connections are kept open, not re-opened for every request.
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// contextTablePrefix starts the name of every context table, so contexts never collide with the other tables.
+const contextTablePrefix = "ctx_"
+
+// contextTableName returns the name of the table holding the entries of a context. SQLite identifiers ignore case,
+// so the name is the lowercased context followed by a short hash of the context itself, telling apart contexts
+// differing by case only.
+func contextTableName(context string) string {
+	sum := sha256.Sum256([]byte(context))
+	return contextTablePrefix + strings.ToLower(context) + "_" + hex.EncodeToString(sum[:4])
+}
+
+// contextTableVersion is the user_version of a database whose context tables are named by contextTableName.
+// Version 0 named them after their context.
+const contextTableVersion = 1
+
+// contextTable returns the quoted identifier of the table holding the entries of a context. It is the only way a
+// context name gets into SQL, keys and values are always bound as parameters.
+func contextTable(context string) string {
+	return quoteIdentifier(contextTableName(context))
+}
+
+// quoteIdentifier quotes an SQL identifier, doubling the quotes inside it.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// createContextDataTable creates a table for storing key-value pairs in a specific context.
+func createContextDataTable(db dbExecutor, context string) error {
+	logStuff("creating context " + context + " table.")
+	createTableSQL := "CREATE TABLE IF NOT EXISTS " + contextTable(context) + " (key TEXT UNIQUE,value TEXT,expires_at INTEGER NOT NULL DEFAULT 0,version INTEGER NOT NULL DEFAULT 1);"
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return err
+	}
+	return createContextExpiryIndex(db, context)
+}
+
+// createContextExpiryIndex indexes the expiry time of a context table, used to find expired entries.
+func createContextExpiryIndex(db dbExecutor, context string) error {
+	createIndexSQL := "CREATE INDEX IF NOT EXISTS " + quoteIdentifier(contextTableName(context)+"_expires_at") +
+		" ON " + contextTable(context) + " (expires_at);"
+	_, err := db.Exec(createIndexSQL)
+	return err
+}
+
+// migrateContextTableNames renames the context tables created by earlier versions after contextTableName, dropping
+// their expiry index, and makes context names unique whatever their case, once: the database is then marked with
+// contextTableVersion. Tables first get a name no context table could have had, so a context named like the new
+// name of another one is renamed as well. Contexts differing by case only shared a table, whose entries can't be
+// told apart, so they stop the migration until all but one of them are deleted.
+func migrateContextTableNames(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version;").Scan(&version)
+	if err != nil || version >= contextTableVersion {
+		return err
+	}
+
+	contexts, err := listContexts(db)
+	if err != nil {
+		return err
+	}
+	var collisions []error
+	seen := make(map[string]string)
+	for _, context := range contexts {
+		if other, ok := seen[strings.ToLower(context)]; ok {
+			collisions = append(collisions, fmt.Errorf("contexts %s and %s differ by case only and share their entries, "+
+				"delete all but one of them from the context table", other, context))
+		}
+		seen[strings.ToLower(context)] = context
+	}
+	if len(collisions) > 0 {
+		return errors.Join(collisions...)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var renamed []string
+	for _, context := range contexts {
+		if validateContextName(context) != nil {
+			logStuff("context " + context + " doesn't match the context name grammar, it can only be deleted.")
+		}
+		table := context
+		var found int
+		err = tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;", table).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found == 0 {
+			continue
+		}
+		_, err = tx.Exec("DROP INDEX IF EXISTS " + quoteIdentifier(table+"_expires_at") + ";")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("ALTER TABLE " + quoteIdentifier(table) + " RENAME TO " + quoteIdentifier("0_"+table) + ";")
+		if err != nil {
+			return err
+		}
+		renamed = append(renamed, context)
+	}
+	for _, context := range renamed {
+		logStuff("renaming context " + context + " table to " + contextTableName(context) + ".")
+		_, err = tx.Exec("ALTER TABLE " + quoteIdentifier("0_"+context) + " RENAME TO " + contextTable(context) + ";")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS context_name_lower ON context (lower(name));")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", contextTableVersion))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateContextDataTables adds the columns introduced after a context table was created.
+func migrateContextDataTables(db *sql.DB) error {
+	contexts, err := listContexts(db)
+	if err != nil {
+		return err
+	}
+	for _, context := range contexts {
+		columns, err := tableColumns(db, contextTableName(context))
+		if err != nil {
+			return err
+		}
+		if !columns["expires_at"] {
+			logStuff("adding expires_at to context " + context + " table.")
+			_, err = db.Exec("ALTER TABLE " + contextTable(context) + " ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;")
+			if err != nil {
+				return err
+			}
+		}
+		if !columns["version"] {
+			logStuff("adding version to context " + context + " table.")
+			_, err = db.Exec("ALTER TABLE " + contextTable(context) + " ADD COLUMN version INTEGER NOT NULL DEFAULT 1;")
+			if err != nil {
+				return err
+			}
+		}
+		err = createContextExpiryIndex(db, context)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateTokenTable adds the metadata columns introduced after the token table was created,
+// and gives an ID to the tokens created before tokens had one.
+func migrateTokenTable(db *sql.DB) error {
+	columns, err := tableColumns(db, "token")
+	if err != nil {
+		return err
+	}
+	for _, column := range []struct{ name, definition string }{
+		{"id", "TEXT"},
+		{"name", "TEXT NOT NULL DEFAULT ''"},
+		{"labels", "TEXT NOT NULL DEFAULT '{}'"},
+		{"created_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"expires_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"last_used_at", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if columns[column.name] {
+			continue
+		}
+		logStuff("adding " + column.name + " to token table.")
+		_, err = db.Exec("ALTER TABLE token ADD COLUMN " + column.name + " " + column.definition + ";")
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query("SELECT token FROM token WHERE id IS NULL;")
+	if err != nil {
+		return err
+	}
+	var legacy []string
+	for rows.Next() {
+		var tokenSha string
+		if err := rows.Scan(&tokenSha); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, tokenSha)
+	}
+	rows.Close()
+	for _, tokenSha := range legacy {
+		_, err = db.Exec("UPDATE token SET id = ? WHERE token = ?;", legacyTokenID(tokenSha), tokenSha)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// permissionTableSQL returns the statement creating a permission table, granting to the owner column. A
+// permission can be granted several times on a context, once per key prefix.
+func permissionTableSQL(table string, owner string) string {
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (
+		` + owner + ` TEXT,
+		permission TEXT,
+		context TEXT,
+		key_prefix TEXT NOT NULL DEFAULT '',
+		UNIQUE (` + owner + `, permission, context, key_prefix)
+	);`
+}
+
+// migratePermissionTables adds the key prefix of grants to permission tables created by earlier versions, and
+// rebuilds those allowing a single key prefix per permission on a context.
+func migratePermissionTables(db *sql.DB) error {
+	for table, owner := range map[string]string{"permission": "token", "role_permission": "role"} {
+		columns, err := tableColumns(db, table)
+		if err != nil {
+			return err
+		}
+		if !columns["key_prefix"] {
+			logStuff("adding key_prefix to " + table + " table.")
+			_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN key_prefix TEXT NOT NULL DEFAULT '';")
+			if err != nil {
+				return err
+			}
+		}
+
+		var unique int
+		err = db.QueryRow(`SELECT COUNT(*) FROM pragma_index_list(?) AS list, pragma_index_info(list.name) AS info
+			WHERE list."unique" = 1 AND info.name = 'key_prefix';`, table).Scan(&unique)
+		if err != nil {
+			return err
+		}
+		if unique > 0 {
+			continue
+		}
+		err = rebuildPermissionTable(db, table, owner)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildPermissionTable recreates a permission table with the current schema, keeping its grants.
+func rebuildPermissionTable(db *sql.DB, table string, owner string) error {
+	logStuff("rebuilding " + table + " table to allow several key prefixes per grant.")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("ALTER TABLE " + table + " RENAME TO " + quoteIdentifier("0_"+table) + ";")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(permissionTableSQL(table, owner))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO " + table + " (" + owner + ", permission, context, key_prefix) SELECT " + owner +
+		", permission, context, key_prefix FROM " + quoteIdentifier("0_"+table) + ";")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DROP TABLE " + quoteIdentifier("0_"+table) + ";")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableColumns returns the set of column names of a table.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// deleteContextDataTable deletes a table for a specific context.
+func deleteContextDataTable(db dbExecutor, context string) error {
+	logStuff("deleting context " + context + " table.")
+	dropTableSQL := "DROP TABLE IF EXISTS " + contextTable(context) + ";"
+
+	_, err := db.Exec(dropTableSQL)
+	return err
+}
+
+// createContextTable creates a table to store context names.
+func createContextTable(db *sql.DB) {
+	logStuff("creating context table")
+	createTableSQL := `CREATE TABLE IF NOT EXISTS context (
+		name TEXT UNIQUE
+	);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Table context created successfully!")
+}
+
+// createTokenTable creates a table to store tokens.
+func createTokenTable(db *sql.DB) {
+	logStuff("create token table")
+	createTableSQL := `CREATE TABLE IF NOT EXISTS token (
+		token TEXT UNIQUE,
+		id TEXT,
+		name TEXT NOT NULL DEFAULT '',
+		labels TEXT NOT NULL DEFAULT '{}',
+		created_at INTEGER NOT NULL DEFAULT 0,
+		expires_at INTEGER NOT NULL DEFAULT 0,
+		last_used_at INTEGER NOT NULL DEFAULT 0
+	);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Table token created successfully!")
+}
+
+// createPermissionTable creates a table to store permissions associated with tokens and contexts.
+func createPermissionTable(db *sql.DB) {
+	logStuff("create permission table")
+	_, err := db.Exec(permissionTableSQL("permission", "token"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Table permission created successfully!")
+}
+
+// createRoleTables creates the tables to store roles, the permissions they grant and the roles held by tokens.
+func createRoleTables(db *sql.DB) {
+	logStuff("create role tables")
+	createTablesSQL := `CREATE TABLE IF NOT EXISTS role (
+		name TEXT UNIQUE
+	);
+	` + permissionTableSQL("role_permission", "role") + `
+	CREATE TABLE IF NOT EXISTS token_role (
+		token TEXT,
+		role TEXT,
+		UNIQUE (token, role)
+	);`
+
+	_, err := db.Exec(createTablesSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Tables role, role_permission and token_role created successfully!")
+}
+
+// createEntry inserts a key-value pair into a specific context table at version 1, expiring at expiresAt
+// (unix milliseconds, 0 for never). An expired entry still stored under the key is replaced.
+func createEntry(db dbExecutor, context string, key string, value string, expiresAt int64) (string, string, string, error) {
+	insertEntrySQL := "INSERT INTO " + contextTable(context) + ` (key, value, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at, version = 1
+		WHERE expires_at != 0 AND expires_at <= ?`
+	result, err := db.Exec(insertEntrySQL, key, value, expiresAt, time.Now().UnixMilli())
+	if err != nil {
+		logStuff("error on creating entry " + key + " on context: " + context)
+		logStuff(err.Error())
+		return "", "", "", err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		logStuff("error on creating entry " + key + " on context: " + context)
+		return "", "", "", errors.New("key already exists")
+	}
+	logStuff("creating entry " + key + " on context: " + context)
+	return context, key, value, nil
+}
+
+// getEntry retrieves the entry for a specific key from a context table, unless it expired.
+func getEntry(db dbExecutor, context string, key string) (entry, error) {
+	logStuff("Searching for key " + key + " on context " + context)
+	e, found, err := lookupEntry(db, context, key)
+	if err != nil {
+		logStuff("error " + err.Error())
+		return entry{}, err
+	}
+
+	if !found {
+		logStuff("error on returning entry " + key + " from context " + context)
+		return entry{}, errNoEntry(context, key)
+	}
+
+	logStuff("returning entry " + key + " from context " + context)
+	return e, nil
+}
+
+// lookupEntry retrieves the entry for a specific key from a context table and reports whether it was found
+// unexpired.
+func lookupEntry(db dbExecutor, context string, key string) (entry, bool, error) {
+	var e entry
+	err := db.QueryRow("SELECT key, value, expires_at, version FROM "+contextTable(context)+" WHERE key = ? AND (expires_at = 0 OR expires_at > ?);",
+		key, time.Now().UnixMilli()).Scan(&e.Key, &e.Value, &e.ExpiresAt, &e.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry{}, false, nil
+	}
+	if err != nil {
+		return entry{}, false, err
+	}
+	return e, true, nil
+}
+
+// getEntries retrieves the unexpired entries stored under any of keys from a context table, by key, in a single query.
+func getEntries(db dbExecutor, context string, keys []string) (map[string]entry, error) {
+	entries := make(map[string]entry, len(keys))
+	if len(keys) == 0 {
+		return entries, nil
+	}
+
+	args := []any{time.Now().UnixMilli()}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+	rows, err := db.Query("SELECT key, value, expires_at, version FROM "+contextTable(context)+" WHERE (expires_at = 0 OR expires_at > ?) AND key IN ("+placeholders+");",
+		args...)
+	if err != nil {
+		logStuff("error on returning entries from context " + context)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e entry
+		err := rows.Scan(&e.Key, &e.Value, &e.ExpiresAt, &e.Version)
+		if err != nil {
+			return nil, err
+		}
+		entries[e.Key] = e
+	}
+	logStuff(fmt.Sprintf("returning %d of %d entries from context %s", len(entries), len(keys), context))
+	return entries, rows.Err()
+}
+
+// updateEntry updates the value and the expiry time for a specific key in a context table, unless it expired,
+// and returns the new version of the entry. When expectedVersion isn't 0 the entry must be at that version.
+func updateEntry(db dbExecutor, context string, key string, value string, expiresAt int64, expectedVersion int64) (int64, error) {
+	updateEntrySQL := "UPDATE " + contextTable(context) + ` SET value = ?, expires_at = ?, version = version + 1
+		WHERE key = ? AND (expires_at = 0 OR expires_at > ?) AND (? = 0 OR version = ?) RETURNING version`
+	var version int64
+	err := db.QueryRow(updateEntrySQL, value, expiresAt, key, time.Now().UnixMilli(), expectedVersion, expectedVersion).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		logStuff("error on updating entry " + key + " on context :" + context)
+		return 0, missingOrMismatch(db, context, key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	logStuff("updating entry " + key + " on context :" + context)
+	return version, nil
+}
+
+// missingOrMismatch tells why a conditional write matched no entry: either the key doesn't exist
+// or the entry is at another version than expected.
+func missingOrMismatch(db dbExecutor, context string, key string) error {
+	_, err := getEntry(db, context, key)
+	if err != nil {
+		return errors.New("key-value pair doesn't exists")
+	}
+	return errVersionMismatch
+}
+
+// listEntries returns up to limit key-value pairs of a context table in lexical key order,
+// keeping only the unexpired keys starting with prefix and coming after the key after.
+func listEntries(db *sql.DB, context string, prefix string, after string, limit int) ([]entry, error) {
+	listEntriesSQL := "SELECT key, value, expires_at, version FROM " + contextTable(context) + ` WHERE key > ? AND key >= ? AND (expires_at = 0 OR expires_at > ?)`
+	args := []any{after, prefix, time.Now().UnixMilli()}
+	if end, ok := prefixEnd(prefix); ok {
+		listEntriesSQL += ` AND key < ?`
+		args = append(args, end)
+	}
+	listEntriesSQL += ` ORDER BY key LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(listEntriesSQL, args...)
+	if err != nil {
+		logStuff("error on listing entries from context " + context)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		err := rows.Scan(&e.Key, &e.Value, &e.ExpiresAt, &e.Version)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	logStuff("listing entries from context " + context)
+	return entries, rows.Err()
+}
+
+// deleteEntry deletes a key-value pair from a context table, unless it expired.
+// When expectedVersion isn't 0 the entry must be at that version.
+func deleteEntry(db dbExecutor, context string, key string, expectedVersion int64) error {
+	deleteEntrySQL := "DELETE FROM " + contextTable(context) + ` WHERE key = ? AND (expires_at = 0 OR expires_at > ?) AND (? = 0 OR version = ?)`
+	result, err := db.Exec(deleteEntrySQL, key, time.Now().UnixMilli(), expectedVersion, expectedVersion)
+	if err != nil {
+		logStuff("error on deleting entry " + key + " from context " + context)
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		logStuff("error on deleting entry " + key + " from context " + context)
+		return missingOrMismatch(db, context, key)
+	}
+	logStuff("deleting entry " + key + " from context " + context)
+	return nil
+}
+
+// reapExpiredEntries physically deletes up to limit expired entries from a context table
+// and returns the keys deleted.
+func reapExpiredEntries(db *sql.DB, context string, limit int) ([]string, error) {
+	reapSQL := "DELETE FROM " + contextTable(context) + ` WHERE rowid IN
+		(SELECT rowid FROM ` + contextTable(context) + ` WHERE expires_at != 0 AND expires_at <= ? LIMIT ?) RETURNING key`
+	rows, err := db.Query(reapSQL, time.Now().UnixMilli(), limit)
+	if err != nil {
+		logStuff("error on reaping expired entries from context " + context)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) > 0 {
+		logStuff(fmt.Sprintf("reaped %d expired entries from context %s", len(keys), context))
+	}
+	return keys, rows.Err()
+}
+
+// createContext inserts a new context name into the context table.
+func createContext(db dbExecutor, name string) (string, error) {
+	insertContextSQL := `INSERT INTO context (name) VALUES (?)`
+	_, err := db.Exec(insertContextSQL, name)
+	if err != nil {
+		logStuff("error on creating context " + name)
+		return "", err
+	}
+	logStuff("creating context " + name)
+	return name, nil
+}
+
+// listContexts returns the names of every context in the context table.
+func listContexts(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM context ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// getContext retrieves a context name from the context table.
+func getContext(db *sql.DB, name string) (string, error) {
+	rows, err := db.Query("SELECT name FROM context WHERE name = ?", name)
+	if err != nil {
+		logStuff("error on returning context " + name)
+		return "", err
+	}
+	defer rows.Close()
+
+	var value string
+	var found bool
+	for rows.Next() {
+		err := rows.Scan(&value)
+		if err != nil {
+			return "", err
+		}
+		found = true
+	}
+
+	if !found {
+		logStuff("error on returning context " + name)
+		return "", fmt.Errorf("no context : %s", name)
+	}
+
+	logStuff("returning context " + name)
+	return value, nil
+}
+
+// deleteContext deletes a context name from the context table.
+func deleteContext(db dbExecutor, name string) error {
+	deleteContextSQL := `DELETE FROM context WHERE name = ?`
+	result, err := db.Exec(deleteContextSQL, name)
+	if err != nil {
+		logStuff("error on deleting context " + name)
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		logStuff("error on deleting context " + name)
+		return errors.New("context doesn't exists")
+	}
+	logStuff("deleting context " + name)
+	return nil
+}
+
+// createToken generates a new token and inserts it into the token table.
+func createToken(db dbExecutor, info tokenInfo) (string, error) {
+	return insertToken(db, uuid.New().String(), info)
+}
+
+// insertToken inserts a token with a given secret into the token table.
+func insertToken(db dbExecutor, secret string, info tokenInfo) (string, error) {
+	tokenSha := tokenToSha256(secret)
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+	labels, err := json.Marshal(info.Labels)
+	if err != nil {
+		return "", err
+	}
+	insertTokenSQL := `INSERT INTO token (token, id, name, labels, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(insertTokenSQL, tokenSha, info.ID, info.Name, string(labels), info.CreatedAt, info.ExpiresAt)
+	if err != nil {
+		logStuff("error on creating token")
+		return "", err
+	}
+	logStuff("creating token " + info.ID)
+	return secret, nil
+}
+
+// tokenExpired checks if a token exists and expired, returning errTokenExpired if so,
+// and returns its metadata.
+func tokenExpired(db *sql.DB, tokenSha string) (tokenInfo, error) {
+	var info tokenInfo
+	err := db.QueryRow("SELECT id, expires_at, last_used_at FROM token WHERE token = ?;",
+		tokenSha).Scan(&info.ID, &info.ExpiresAt, &info.LastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return tokenInfo{}, nil
+	}
+	if err != nil {
+		return tokenInfo{}, err
+	}
+	if expired(info.ExpiresAt, time.Now().UnixMilli()) {
+		logStuff("token " + info.ID + " expired")
+		return info, errTokenExpired
+	}
+	return info, nil
+}
+
+// useToken records that a token was just used, unless it already was within tokenUseResolution.
+func useToken(db *sql.DB, tokenSha string, info tokenInfo) {
+	now := time.Now()
+	if info.ID == "" || now.Sub(time.UnixMilli(info.LastUsedAt)) < tokenUseResolution {
+		return
+	}
+	_, err := db.Exec("UPDATE token SET last_used_at = ? WHERE token = ?;", now.UnixMilli(), tokenSha)
+	if err != nil {
+		logStuff("error on recording the use of token " + info.ID)
+	}
+}
+
+// getTokenInfo returns the metadata of a token.
+func getTokenInfo(db *sql.DB, token string) (tokenInfo, error) {
+	var info tokenInfo
+	var labels string
+	err := db.QueryRow("SELECT id, name, labels, created_at, expires_at, last_used_at FROM token WHERE token = ?;",
+		tokenToSha256(token)).Scan(&info.ID, &info.Name, &labels, &info.CreatedAt, &info.ExpiresAt, &info.LastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return tokenInfo{}, errNoToken
+	}
+	if err != nil {
+		return tokenInfo{}, err
+	}
+	return info, json.Unmarshal([]byte(labels), &info.Labels)
+}
+
+// rotateToken replaces the token with a given ID by a new one holding the same metadata and permissions,
+// in a single transaction. The old token is deleted, or expires after grace when grace isn't 0.
+func rotateToken(db *sql.DB, id string, grace time.Duration) (tokenInfo, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return tokenInfo{}, "", err
+	}
+	defer tx.Rollback()
+
+	var oldSha string
+	var old tokenInfo
+	var labels string
+	err = tx.QueryRow("SELECT token, name, labels, expires_at FROM token WHERE id = ?;", id).Scan(&oldSha, &old.Name, &labels, &old.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		logStuff("error on rotating token " + id)
+		return tokenInfo{}, "", errNoToken
+	}
+	if err != nil {
+		return tokenInfo{}, "", err
+	}
+	if expired(old.ExpiresAt, time.Now().UnixMilli()) {
+		logStuff("error on rotating token " + id + ", token expired")
+		return tokenInfo{}, "", errTokenExpired
+	}
+	err = json.Unmarshal([]byte(labels), &old.Labels)
+	if err != nil {
+		return tokenInfo{}, "", err
+	}
+
+	// Create the new token and copy every permission and role of the old one.
+	info := newTokenInfo(old.Name, old.Labels, old.ExpiresAt)
+	token, err := createToken(tx, info)
+	if err != nil {
+		return tokenInfo{}, "", err
+	}
+	_, err = tx.Exec(`INSERT INTO permission (token, permission, context, key_prefix)
+		SELECT ?, permission, context, key_prefix FROM permission WHERE token = ?`, tokenToSha256(token), oldSha)
+	if err != nil {
+		return tokenInfo{}, "", err
+	}
+	_, err = tx.Exec(`INSERT INTO token_role (token, role)
+		SELECT ?, role FROM token_role WHERE token = ?`, tokenToSha256(token), oldSha)
+	if err != nil {
+		return tokenInfo{}, "", err
+	}
+
+	// Retire the old token.
+	if expiresAt := rotatedExpiry(old.ExpiresAt, grace); expiresAt != 0 {
+		_, err = tx.Exec("UPDATE token SET expires_at = ? WHERE token = ?;", expiresAt, oldSha)
+	} else {
+		for _, table := range []string{"permission", "token_role", "token"} {
+			if err == nil {
+				_, err = tx.Exec("DELETE FROM "+table+" WHERE token = ?;", oldSha)
+			}
+		}
+	}
+	if err != nil {
+		return tokenInfo{}, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return tokenInfo{}, "", err
+	}
+	logStuff("rotating token " + id + " to token " + info.ID)
+	return info, token, nil
+}
+
+// listTokens returns the metadata of every token in the database, oldest first.
+func listTokens(db *sql.DB) ([]tokenInfo, error) {
+	rows, err := db.Query("SELECT id, name, labels, created_at, expires_at, last_used_at FROM token ORDER BY created_at, id;")
+	if err != nil {
+		logStuff("error on listing tokens")
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []tokenInfo{}
+	for rows.Next() {
+		var info tokenInfo
+		var labels string
+		err := rows.Scan(&info.ID, &info.Name, &labels, &info.CreatedAt, &info.ExpiresAt, &info.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(labels), &info.Labels)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, info)
+	}
+	logStuff("listing tokens")
+	return tokens, rows.Err()
+}
+
+// getTokenGrants returns every permission granted to the token with a given ID.
+func getTokenGrants(db *sql.DB, id string) ([]tokenGrant, error) {
+	tokenSha, err := tokenShaByID(db, id)
+	if err != nil {
+		logStuff("error on listing grants of token " + id)
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT permission, context, key_prefix FROM permission WHERE token = ?;", tokenSha)
+	if err != nil {
+		logStuff("error on listing grants of token " + id)
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []tokenGrant{}
+	for rows.Next() {
+		var grant tokenGrant
+		err := rows.Scan(&grant.Permission, &grant.Context, &grant.KeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	sortGrants(grants)
+	logStuff("listing grants of token " + id)
+	return grants, rows.Err()
+}
+
+// purgeExpiredTokens deletes the expired tokens and their associated permissions from the database
+// and returns how many tokens were deleted.
+func purgeExpiredTokens(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	for _, table := range []string{"permission", "token_role"} {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE token IN
+			(SELECT token FROM token WHERE expires_at != 0 AND expires_at <= ?)`, now)
+		if err != nil {
+			logStuff("error on purging expired tokens")
+			return 0, err
+		}
+	}
+	result, err := tx.Exec(`DELETE FROM token WHERE expires_at != 0 AND expires_at <= ?`, now)
+	if err != nil {
+		logStuff("error on purging expired tokens")
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected > 0 {
+		logStuff(fmt.Sprintf("purged %d expired tokens", rowsAffected))
+	}
+	return int(rowsAffected), nil
+}
+
+// getPermission checks if the token of a credential has a specific permission in a context, unless it expired.
+func getPermission(db *sql.DB, cred credential, context string, reqType string) error {
+	_, err := getGrants(db, cred, context, reqType)
+	return err
+}
+
+// getGrants checks a permission like getPermission and returns the grants covering the context.
+func getGrants(db *sql.DB, cred credential, context string, reqType string) ([]tokenGrant, error) {
+	tokenSha, err := credentialSha(db, cred)
+	if err != nil {
+		logStuff("error on checking permission for context " + context)
+		return nil, err
+	}
+
+	info, err := tokenExpired(db, tokenSha)
+	cred.resolve(info.ID)
+	if err != nil {
+		logStuff("error on checking permission for context " + context)
+		return nil, err
+	}
+
+	grants, err := tokenPermissionRows(db, tokenSha, reqType)
+	if err != nil {
+		logStuff("error on checking permission for context " + context)
+		return nil, err
+	}
+
+	grants = matchingGrants(grants, reqType, context)
+	if len(grants) == 0 {
+		logStuff("error on checking permission for context " + context)
+		return nil, errors.New("not authorized")
+	}
+	logStuff("checking permission for context " + context)
+	useToken(db, tokenSha, info)
+	return grants, nil
+}
+
+// credentialSha returns the hash the token of a credential is stored under, empty when no token has its ID.
+func credentialSha(db *sql.DB, cred credential) (string, error) {
+	if cred.tokenID == "" {
+		return tokenToSha256(cred.secret), nil
+	}
+	var tokenSha string
+	err := db.QueryRow("SELECT token FROM token WHERE id = ?;", cred.tokenID).Scan(&tokenSha)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return tokenSha, err
+}
+
+// tokenPermissionRows returns the grants of a permission held by a token, both its own and those of its roles.
+func tokenPermissionRows(db *sql.DB, tokenSha string, permission string) ([]tokenGrant, error) {
+	rows, err := db.Query(`SELECT permission, context, key_prefix FROM permission WHERE token = ? AND permission = ?
+		UNION ALL
+		SELECT role_permission.permission, role_permission.context, role_permission.key_prefix FROM token_role
+		JOIN role_permission ON role_permission.role = token_role.role
+		WHERE token_role.token = ? AND role_permission.permission = ?;`,
+		tokenSha, permission, tokenSha, permission)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []tokenGrant
+	for rows.Next() {
+		var grant tokenGrant
+		err := rows.Scan(&grant.Permission, &grant.Context, &grant.KeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// deleteToken deletes a token and its associated permissions from the database, in a single transaction
+// so a failure never leaves the token without its grants.
+func deleteToken(db *sql.DB, token string) error {
+    // Convert the token to its SHA-256 hash.
+    tokenSha := tokenToSha256(token)
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    // SQL query to delete permissions associated with the token.
+    deleteTokenPermissionsSQL := `DELETE FROM permission WHERE token = ?`
+    _, err = tx.Exec(deleteTokenPermissionsSQL, tokenSha)
+    if err != nil {
+        return err
+    }
+
+    // SQL query to take the roles away from the token.
+    _, err = tx.Exec(`DELETE FROM token_role WHERE token = ?`, tokenSha)
+    if err != nil {
+        return err
+    }
+
+    // SQL query to delete the token itself.
+    var result sql.Result
+    deleteTokenSQL := `DELETE FROM token WHERE token = ?`
+    result, err = tx.Exec(deleteTokenSQL, tokenSha)
+    if err != nil {
+        logStuff("error on deleting token")
+        return err
+    }
+
+    // Check if any rows were affected by the delete operation.
+    rowsAffected, _ := result.RowsAffected()
+    if rowsAffected == 0 {
+        logStuff("error on deleting token")
+        return errors.New("token doesn't exist")
+    }
+
+    logStuff("deleting token")
+    return tx.Commit()
+}
+
+// grantTokenPermission grants a specific permission to a token within a given context,
+// limited to the keys starting with keyPrefix when it isn't empty.
+func grantTokenPermission(db dbExecutor, token string, permission string, context string, keyPrefix string) (string, string, string, error) {
+    // Convert the token to its SHA-256 hash.
+    tokenSha := tokenToSha256(token)
+
+    // SQL query to insert the new permission.
+    insertPermissionSQL := `INSERT INTO permission (token, permission, context, key_prefix) VALUES (?, ?, ?, ?)`
+    _, err := db.Exec(insertPermissionSQL, tokenSha, permission, context, keyPrefix)
+    if err != nil {
+        logStuff("error on granting permission on context " + context + " for token")
+        return "", "", "", err
+    }
+    logStuff("granting permission on context " + context + " for token")
+    return token, permission, context, nil
+}
+
+// rovokeTokenPermission revokes a specific permission from a token within a given context.
+func rovokeTokenPermission(db *sql.DB, token string, permission string, context string) error {
+    // Convert the token to its SHA-256 hash.
+    tokenSha := tokenToSha256(token)
+
+    // SQL query to delete the permission.
+    deletePermissionSQL := `DELETE FROM permission WHERE token = ? AND permission = ? AND context = ?`
+    _, err := db.Exec(deletePermissionSQL, tokenSha, permission, context)
+    if err != nil {
+        logStuff("error on revoking permission of a token from the context " + context)
+        return err
+    }
+
+    logStuff("revoking permission of a token from the context " + context)
+    return nil
+}
+
+// createAdmToken creates an admin token with all necessary permissions if it doesn't already exist,
+// with the given secret or a generated one. It runs in a single transaction, so two servers starting on
+// the same database never both create one.
+func createAdmToken(db *sql.DB, secret string) (string, error) {
+    tx, err := db.Begin()
+    if err != nil {
+        return "", err
+    }
+    defer tx.Rollback()
+
+    // Check if an admin token already exists.
+    _, found, _ := admTokenExists(tx)
+
+    if !found {
+        // Create a new token.
+        if secret == "" {
+            secret = uuid.New().String()
+        }
+        token, err := insertToken(tx, secret, newTokenInfo("admin", nil, 0))
+        if err != nil {
+            return "", err
+        }
+        // Grant all necessary permissions to the new admin token.
+        for _, permission := range admPermissions {
+            _, _, _, err = grantTokenPermission(tx, token, permission, "ALL", "")
+            if err != nil {
+                return "", err
+            }
+        }
+        return token, tx.Commit()
+    }
+
+    // Grant the admin permissions added since to the existing master admin tokens.
+    masters, err := masterTokens(tx)
+    if err != nil {
+        return "", err
+    }
+    for _, tokenSha := range masters {
+        for _, permission := range admPermissions {
+            _, err := tx.Exec(`INSERT OR IGNORE INTO permission (token, permission, context) VALUES (?, ?, 'ALL')`,
+                tokenSha, permission)
+            if err != nil {
+                return "", err
+            }
+        }
+    }
+    return "", tx.Commit()
+}
+
+// resetAdmToken deletes every master admin token, or every token holding an admin permission when allAdmins is set,
+// and creates a new master admin token in a single transaction. It returns the new token along with the number of
+// tokens deleted and of delegated admin tokens kept.
+func resetAdmToken(db *sql.DB, allAdmins bool) (string, int, int, error) {
+    tx, err := db.Begin()
+    if err != nil {
+        return "", 0, 0, err
+    }
+    defer tx.Rollback()
+
+    masters, err := masterTokens(tx)
+    if err != nil {
+        return "", 0, 0, err
+    }
+    admins, err := adminTokens(tx)
+    if err != nil {
+        return "", 0, 0, err
+    }
+    removed := masters
+    if allAdmins {
+        removed = admins
+    }
+    for _, tokenSha := range removed {
+        for _, deleteSQL := range []string{
+            `DELETE FROM permission WHERE token = ?`,
+            `DELETE FROM token_role WHERE token = ?`,
+            `DELETE FROM token WHERE token = ?`,
+        } {
+            _, err = tx.Exec(deleteSQL, tokenSha)
+            if err != nil {
+                return "", 0, 0, err
+            }
+        }
+    }
+
+    token, err := createToken(tx, newTokenInfo("admin", nil, 0))
+    if err != nil {
+        return "", 0, 0, err
+    }
+    for _, permission := range admPermissions {
+        _, _, _, err = grantTokenPermission(tx, token, permission, "ALL", "")
+        if err != nil {
+            return "", 0, 0, err
+        }
+    }
+
+    logStuff(fmt.Sprintf("replacing %d adm tokens by a new one", len(removed)))
+    return token, len(removed), len(admins) - len(removed), tx.Commit()
+}
+
+// admTokenExists checks if a master admin token already exists in the database.
+func admTokenExists(db dbExecutor) (string, bool, error) {
+    masters, err := masterTokens(db)
+    if err != nil {
+        return "", false, err
+    }
+    if len(masters) == 0 {
+        return "", false, errors.New("adm token does not exist")
+    }
+    return masters[0], true, nil
+}
+
+// masterTokens returns the hashes of the master admin tokens, those holding every master admin permission
+// on "ALL", unlike delegated admin tokens.
+func masterTokens(db dbExecutor) ([]string, error) {
+    args := []interface{}{}
+    for _, permission := range masterAdmPermissions {
+        args = append(args, permission)
+    }
+    args = append(args, len(masterAdmPermissions))
+    rows, err := db.Query(`SELECT token FROM permission WHERE context = 'ALL' AND permission IN (?`+
+        strings.Repeat(", ?", len(masterAdmPermissions)-1)+`)
+        GROUP BY token HAVING COUNT(DISTINCT permission) = ?`, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var masters []string
+    for rows.Next() {
+        var tokenSha string
+        err := rows.Scan(&tokenSha)
+        if err != nil {
+            return nil, err
+        }
+        masters = append(masters, tokenSha)
+    }
+    return masters, rows.Err()
+}
+
+// adminTokens returns the hashes of the tokens holding any admin permission, master and delegated admin tokens alike.
+func adminTokens(db dbExecutor) ([]string, error) {
+    args := []interface{}{}
+    for _, permission := range admPermissions {
+        args = append(args, permission)
+    }
+    rows, err := db.Query(`SELECT DISTINCT token FROM permission WHERE permission IN (?`+
+        strings.Repeat(", ?", len(admPermissions)-1)+`)`, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var admins []string
+    for rows.Next() {
+        var tokenSha string
+        err := rows.Scan(&tokenSha)
+        if err != nil {
+            return nil, err
+        }
+        admins = append(admins, tokenSha)
+    }
+    return admins, rows.Err()
+}
+
+// getToken checks if a token exists in the database, unless it expired.
+func getToken(db *sql.DB, token string) error {
+    // Convert the token to its SHA-256 hash.
+    tokenSha := tokenToSha256(token)
+
+    // SQL query to check if the token exists.
+    rows, err := db.Query("SELECT token FROM token WHERE token = ? ", tokenSha)
+    if err != nil {
+        logStuff("error on checking if token exists")
+        return err
+    }
+    defer rows.Close()
+
+    var found bool
+    for rows.Next() {
+        found = true
+    }
+
+    if !found {
+        logStuff("error on checking if token exists")
+        return errors.New("token does not exist")
+    }
+
+    // Check if the token expired.
+    _, err = tokenExpired(db, tokenSha)
+    if err != nil {
+        logStuff("error on checking if token exists")
+        return err
+    }
+
+    logStuff("checking if token exists")
+    return nil
+}
+
+// tokenShaByID returns the hash of the token with a given ID.
+func tokenShaByID(db dbExecutor, id string) (string, error) {
+	var tokenSha string
+	err := db.QueryRow("SELECT token FROM token WHERE id = ?;", id).Scan(&tokenSha)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errNoToken
+	}
+	return tokenSha, err
+}
+
+// getTokenRoles returns the names of the roles held by the token with a given ID.
+func getTokenRoles(db *sql.DB, id string) ([]string, error) {
+	tokenSha, err := tokenShaByID(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT role FROM token_role WHERE token = ? ORDER BY role;", tokenSha)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// createRole inserts a new role without any permission.
+func createRole(db *sql.DB, name string) error {
+	result, err := db.Exec("INSERT OR IGNORE INTO role (name) VALUES (?);", name)
+	if err != nil {
+		logStuff("error on creating role " + name)
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		logStuff("error on creating role " + name)
+		return errors.New("role already exists")
+	}
+	logStuff("creating role " + name)
+	return nil
+}
+
+// deleteRole deletes a role with its permissions, and takes it away from every token holding it.
+func deleteRole(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM role WHERE name = ?;", name)
+	if err != nil {
+		logStuff("error on deleting role " + name)
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		logStuff("error on deleting role " + name)
+		return errNoRole
+	}
+	for _, table := range []string{"role_permission", "token_role"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE role = ?;", name)
+		if err != nil {
+			logStuff("error on deleting role " + name)
+			return err
+		}
+	}
+
+	logStuff("deleting role " + name)
+	return tx.Commit()
+}
+
+// listRoles returns every role with its permissions, by name.
+func listRoles(db *sql.DB) ([]role, error) {
+	rows, err := db.Query(`SELECT role.name, role_permission.permission, role_permission.context, role_permission.key_prefix FROM role
+		LEFT JOIN role_permission ON role_permission.role = role.name
+		ORDER BY role.name, role_permission.context, role_permission.permission;`)
+	if err != nil {
+		logStuff("error on listing roles")
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []role{}
+	for rows.Next() {
+		var name string
+		var permission, context, keyPrefix sql.NullString
+		err := rows.Scan(&name, &permission, &context, &keyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(roles) == 0 || roles[len(roles)-1].Name != name {
+			roles = append(roles, role{Name: name, Grants: []tokenGrant{}})
+		}
+		if permission.Valid {
+			last := &roles[len(roles)-1]
+			last.Grants = append(last.Grants, tokenGrant{Permission: permission.String, Context: context.String, KeyPrefix: keyPrefix.String})
+		}
+	}
+	logStuff("listing roles")
+	return roles, rows.Err()
+}
+
+// roleExists checks if a role exists.
+func roleExists(db *sql.DB, name string) error {
+	var found string
+	err := db.QueryRow("SELECT name FROM role WHERE name = ?;", name).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNoRole
+	}
+	return err
+}
+
+// grantRolePermission grants a permission to a role on a context pattern, limited to the keys
+// starting with keyPrefix when it isn't empty.
+func grantRolePermission(db *sql.DB, name string, permission string, pattern string, keyPrefix string) error {
+	err := roleExists(db, name)
+	if err != nil {
+		logStuff("error on granting permission on " + pattern + " to role " + name)
+		return err
+	}
+	result, err := db.Exec("INSERT OR IGNORE INTO role_permission (role, permission, context, key_prefix) VALUES (?, ?, ?, ?);",
+		name, permission, pattern, keyPrefix)
+	if err != nil {
+		logStuff("error on granting permission on " + pattern + " to role " + name)
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		logStuff("error on granting permission on " + pattern + " to role " + name)
+		return errors.New("permission already granted")
+	}
+	logStuff("granting permission on " + pattern + " to role " + name)
+	return nil
+}
+
+// revokeRolePermission revokes a permission of a role on a context pattern.
+func revokeRolePermission(db *sql.DB, name string, permission string, pattern string) error {
+	err := roleExists(db, name)
+	if err != nil {
+		logStuff("error on revoking permission on " + pattern + " from role " + name)
+		return err
+	}
+	_, err = db.Exec("DELETE FROM role_permission WHERE role = ? AND permission = ? AND context = ?;",
+		name, permission, pattern)
+	if err != nil {
+		logStuff("error on revoking permission on " + pattern + " from role " + name)
+		return err
+	}
+	logStuff("revoking permission on " + pattern + " from role " + name)
+	return nil
+}
+
+// assignRole gives a role to the token with a given ID.
+func assignRole(db *sql.DB, id string, name string) error {
+	tokenSha, err := tokenShaByID(db, id)
+	if err != nil {
+		return err
+	}
+	err = roleExists(db, name)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec("INSERT OR IGNORE INTO token_role (token, role) VALUES (?, ?);", tokenSha, name)
+	if err != nil {
+		logStuff("error on assigning role " + name + " to token " + id)
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		logStuff("error on assigning role " + name + " to token " + id)
+		return errors.New("role already assigned")
+	}
+	logStuff("assigning role " + name + " to token " + id)
+	return nil
+}
+
+// unassignRole takes a role away from the token with a given ID.
+func unassignRole(db *sql.DB, id string, name string) error {
+	tokenSha, err := tokenShaByID(db, id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM token_role WHERE token = ? AND role = ?;", tokenSha, name)
+	if err != nil {
+		logStuff("error on unassigning role " + name + " from token " + id)
+		return err
+	}
+	logStuff("unassigning role " + name + " from token " + id)
+	return nil
+}
@@ -1,64 +1,141 @@
-package main
-
-import (
-	"fmt"
-	"log"
-	"net/http"
-	"flag"
-	"strconv"
-)
-
-func main() {	
-	// Connect to SQLite
-	db, err := connectSQLite() // For SQLite
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-
-	createContextTable(db)
-	createTokenTable(db)
-	createPermissionTable(db)
-
-	var token string
-
-	token, _ = createAdmToken(db)
-
-	if token != "" {
-		fmt.Println("Master adm token : " + token)
-	} else {
-		fmt.Println("ADM TOKEN ALREADY CREATED")
-	}
-
-	http.HandleFunc("POST /con/{id}", conPost)
-	http.HandleFunc("PUT /con/{id}", conPut)
-	http.HandleFunc("GET /con/{id}", conGet)
-	http.HandleFunc("DELETE /con/{id}", conDelete)
-
-	http.HandleFunc("POST /adm/token", admTokenPost)
-	// CREATE : check if adm token exists
-	http.HandleFunc("DELETE /adm/token", admTokenDelete)
-
-	http.HandleFunc("POST /adm/context", admContextPost)
-	http.HandleFunc("GET /adm/context", admContextGet)
-	// CREATE : check contexts, return all contexts
-	http.HandleFunc("DELETE /adm/context", admContextDelete)
-
-	http.HandleFunc("POST /adm/token/grant", admTokenGrant)
-	// CREATE : check a token grant on context
-	http.HandleFunc("DELETE /adm/token/revoke", admTokenRevoke)
-
-	// Define a flag named "port" with a default value of 8080 and a description.
-	port := flag.Int("port", 53072, "Define the port number")
-	
-	// Parse the flags
-	flag.Parse()
-
-	// Convert the port (integer) to a string
-	portStr := strconv.Itoa(*port)
-
-	// Use the port value
-	fmt.Printf("Server will start on port: %d\n", *port)	
-
-	log.Fatal(http.ListenAndServe(":" + portStr, nil))
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"flag"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+func main() {	
+	// Run the subcommand instead of the server when one is given.
+	if len(os.Args) > 1 && os.Args[1] == "reset-admin" {
+		err := runResetAdmin(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		err := runConfig(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err := runServer(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runServer runs the server until it gets SIGINT or SIGTERM, then shuts it down gracefully and closes the storage
+// engine and the audit log, so their last writes are on disk before it returns.
+func runServer(args []string) error {
+	// Read the configuration: the defaults, the configuration file, the environment, then the flags
+	var cfg config
+	var configFile string
+	flags := configFlags(os.Args[0], &cfg, &configFile)
+	err := loadConfig(flags, args, &configFile)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = cfg.validate()
+	if err != nil {
+		return err
+	}
+
+	// Send the logs to the log file
+	if cfg.logFile != "" {
+		logFile, err := os.OpenFile(cfg.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	// Open the audit log
+	var audit *auditLog
+	if cfg.auditFile != "" {
+		audit, err = openAuditLog(cfg.auditFile, cfg.auditMaxSize*1024*1024, cfg.auditMaxFiles, cfg.auditValues, cfg.auditReads)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := audit.close()
+			if err != nil {
+				logStuff("error on closing the audit log: " + err.Error())
+			}
+		}()
+	}
+
+	// Open the storage engine
+	options := cfg.storeOptions()
+	options.changes = newChangeHub()
+	store, err := openStore(options)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := store.close()
+		if err != nil {
+			logStuff("error on closing the store: " + err.Error())
+		}
+	}()
+
+	// Remove expired entries in the background
+	stopReaper := startReaper(store, cfg.reapInterval, cfg.reapBatch)
+	defer stopReaper()
+
+	// Remove expired tokens in the background
+	stopTokenPurger := startTokenPurger(store, cfg.tokenPurgeInterval)
+	defer stopTokenPurger()
+
+	// Create the master admin token at first boot
+	err = bootstrapAdmToken(store, cfg.admTokenFile, cfg.admTokenOutput, options.admTokenPath())
+	if err != nil {
+		return err
+	}
+
+	// Load the TLS files, plain HTTP is only served without them
+	var certs *tlsFiles
+	if cfg.tlsCert != "" {
+		certs, err = openTLSFiles(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	srv := newServer(store, options.changes, audit, certs)
+	httpServer := &http.Server{
+		Addr:    net.JoinHostPort(cfg.bind, strconv.Itoa(cfg.port)),
+		Handler: srv.routes(),
+	}
+
+	// Use the port value
+	if certs != nil {
+		httpServer.TLSConfig = certs.serverConfig()
+		fmt.Printf("Server will start on port: %d using the %s store, over TLS\n", cfg.port, cfg.storeKind)
+	} else {
+		fmt.Printf("Server will start on port: %d using the %s store\n", cfg.port, cfg.storeKind)	
+	}
+
+	// Serve until SIGINT or SIGTERM, a second one stops the server right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	return srv.serve(ctx, httpServer, cfg.shutdownTimeout)
+}
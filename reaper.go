@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+)
+
+// startReaper physically removes expired entries from s every interval, in
+// batches of at most batch entries so a single pass never holds the store for
+// long. The store publishes their expiry to the watchers. It keeps going while
+// full batches come back and returns a function stopping it.
+func startReaper(s Store, interval time.Duration, batch int) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for {
+					reaped, err := s.reapExpired(batch)
+					if err != nil {
+						logStuff("error on reaping expired entries: " + err.Error())
+						break
+					}
+					if len(reaped) < batch {
+						break
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// startTokenPurger removes the expired tokens and their permissions from s
+// every interval and returns a function stopping it.
+func startTokenPurger(s Store, interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.purgeExpiredTokens(); err != nil {
+					logStuff("error on purging expired tokens: " + err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// runResetAdmin is the reset-admin subcommand, the way back in when the
+// master admin token is lost or leaked. It runs against the data files of a
+// stopped server, removes every master admin token, or with -all-admins every
+// token holding an admin permission, and mints a new one, printed or written
+// to a file only its owner can read.
+func runResetAdmin(args []string) error {
+	var c config
+	var configFile string
+	flags := configFlags("reset-admin", &c, &configFile)
+	out := flags.String("out", "", "Define a file the new token is written to instead of being printed")
+	allAdmins := flags.Bool("all-admins", false, "Define if the delegated admin tokens are removed along with the master admin tokens")
+	err := loadConfig(flags, args, &configFile)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = c.validate()
+	if err != nil {
+		return err
+	}
+
+	// The memory store keeps its state in the server process, which would
+	// overwrite the reset with its next snapshot.
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(dialHost(c.bind), strconv.Itoa(c.port)), time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("a server is listening on port %d, stop it before resetting the admin token", c.port)
+	}
+
+	// The memory store isn't snapshotted, the reset is in its log.
+	options := c.storeOptions()
+	options.snapshotInterval = 0
+	s, err := openStore(options)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	token, removed, kept, err := s.resetAdmToken(*allAdmins)
+	if err != nil {
+		return err
+	}
+
+	if *allAdmins {
+		fmt.Printf("Removed %d admin tokens, master and delegated\n", removed)
+	} else {
+		fmt.Printf("Removed %d master admin tokens, kept %d delegated admin tokens (-all-admins removes them too)\n", removed, kept)
+	}
+	if *out == "" {
+		fmt.Println("Master adm token : " + token)
+		return nil
+	}
+	return writeSecretFile(*out, token)
+}
+
+// dialHost returns the host a server listening on bind is reached at.
+func dialHost(bind string) string {
+	if bind == "" {
+		return "localhost"
+	}
+	return bind
+}
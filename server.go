@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// server is the HTTP API of Walkyria. It owns the store every request goes
+// through, with its single pool of database connections, the hub the store
+// publishes its changes to, the audit log, nil when auditing is disabled, and
+// the TLS files, nil when serving plain HTTP. shutdown is closed when the
+// server shuts down, ending the watch streams.
+type server struct {
+	store    Store
+	changes  *changeHub
+	audit    *auditLog
+	tls      *tlsFiles
+	shutdown chan struct{}
+}
+
+// newServer returns a server on top of store, watching the changes published
+// to changes, recording its actions in audit and mapping client certificates
+// to tokens with tls.
+func newServer(store Store, changes *changeHub, audit *auditLog, tls *tlsFiles) *server {
+	return &server{store: store, changes: changes, audit: audit, tls: tls, shutdown: make(chan struct{})}
+}
+
+// serve runs httpServer until ctx is done, then shuts it down gracefully: it
+// stops accepting connections, ends the watch streams, which would never be
+// done otherwise, and waits up to timeout for the requests in flight. The
+// connections still busy after timeout are closed.
+func (s *server) serve(ctx context.Context, httpServer *http.Server, timeout time.Duration) error {
+	httpServer.RegisterOnShutdown(func() {
+		close(s.shutdown)
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		if httpServer.TLSConfig != nil {
+			served <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
+		served <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	logStuff("shutting down, waiting up to " + timeout.String() + " for the requests in flight")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := httpServer.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		httpServer.Close()
+		return errors.New("shutdown-timeout passed with requests in flight, their connections were closed")
+	}
+	if err != nil {
+		return err
+	}
+	logStuff("every request in flight is done")
+	return nil
+}
+
+// routes returns the handler of every route of the API.
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Deprecated body based routes, kept for compatibility with older clients.
+	mux.HandleFunc("POST /con/{id}", s.audited("entry.create", s.conPost))
+	mux.HandleFunc("PUT /con/{id}", s.audited("entry.update", s.conPut))
+	mux.HandleFunc("GET /con/{id}", s.auditedRead("entry.read", s.conGet))
+	mux.HandleFunc("DELETE /con/{id}", s.audited("entry.delete", s.conDelete))
+
+	// A key takes the rest of the path, slashes included. The endpoints of a context are more specific routes,
+	// their names are reserved keys.
+	mux.HandleFunc("POST /con/{id}/{key...}", s.audited("entry.create", s.conKeyPost))
+	mux.HandleFunc("PUT /con/{id}/{key...}", s.audited("entry.update", s.conKeyPut))
+	mux.HandleFunc("GET /con/{id}/{key...}", s.auditedRead("entry.read", s.conKeyGet))
+	mux.HandleFunc("DELETE /con/{id}/{key...}", s.audited("entry.delete", s.conKeyDelete))
+
+	mux.HandleFunc("POST /con/{id}/_batch", s.audited("entry.batch", s.conBatch))
+	mux.HandleFunc("POST /con/{id}/_mget", s.auditedRead("entry.mget", s.conMultiGet))
+	mux.HandleFunc("GET /con/{id}/_watch", s.auditedRead("entry.watch", s.conWatch))
+
+	mux.HandleFunc("POST /adm/token", s.audited("token.create", s.admTokenPost))
+	mux.HandleFunc("GET /adm/token", s.audited("token.list", s.admTokenList))
+	mux.HandleFunc("GET /adm/token/{id}/grants", s.audited("token.grants", s.admTokenGrants))
+	mux.HandleFunc("POST /adm/token/rotate", s.audited("token.rotate", s.admTokenRotate))
+	// CREATE : check if adm token exists
+	mux.HandleFunc("DELETE /adm/token", s.audited("token.delete", s.admTokenDelete))
+
+	mux.HandleFunc("POST /adm/context", s.audited("context.create", s.admContextPost))
+	mux.HandleFunc("GET /adm/context", s.audited("context.read", s.admContextGet))
+	// CREATE : check contexts, return all contexts
+	mux.HandleFunc("DELETE /adm/context", s.audited("context.delete", s.admContextDelete))
+
+	mux.HandleFunc("POST /adm/token/grant", s.audited("token.grant", s.admTokenGrant))
+	// CREATE : check a token grant on context
+	mux.HandleFunc("DELETE /adm/token/revoke", s.audited("token.revoke", s.admTokenRevoke))
+	mux.HandleFunc("POST /adm/token/role", s.audited("token.role.assign", s.admTokenRoleAssign))
+	mux.HandleFunc("DELETE /adm/token/role", s.audited("token.role.unassign", s.admTokenRoleUnassign))
+
+	mux.HandleFunc("POST /adm/role", s.audited("role.create", s.admRolePost))
+	mux.HandleFunc("GET /adm/role", s.audited("role.list", s.admRoleGet))
+	mux.HandleFunc("DELETE /adm/role", s.audited("role.delete", s.admRoleDelete))
+	mux.HandleFunc("POST /adm/role/grant", s.audited("role.grant", s.admRoleGrant))
+	mux.HandleFunc("DELETE /adm/role/revoke", s.audited("role.revoke", s.admRoleRevoke))
+
+	mux.HandleFunc("GET /adm/audit", s.audited("audit.read", s.admAudit))
+
+	return mux
+}
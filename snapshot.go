@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A snapshot is a point-in-time copy of the memory store, written as the
+// sequence of records that rebuilds it. It starts with a walSnapshot record
+// naming the first log segment that is not covered by the snapshot, so boot
+// loads the snapshot and replays only the segments from that one on.
+
+// writeSnapshot atomically replaces the snapshot at path: the records are
+// written to a temporary file, fsynced and then renamed over the old one.
+func writeSnapshot(path string, segment int, records []walRecord) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(file)
+	records = append([]walRecord{{Op: walSnapshot, Segment: segment}}, records...)
+	for _, record := range records {
+		frame, err := appendFrame(nil, record)
+		if err == nil {
+			_, err = writer.Write(frame)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+
+	logStuff(fmt.Sprintf("wrote snapshot of %d records covering wal segments before %d", len(records)-1, segment))
+	return nil
+}
+
+// syncDir fsyncs a directory so a rename inside it is durable. Not every
+// platform can sync directories, so failures are ignored.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+// loadSnapshot calls apply for every record of the snapshot at path and
+// returns the first log segment to replay after it. Without a snapshot every
+// segment has to be replayed, so it returns 0.
+func loadSnapshot(path string, apply func(walRecord) error) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	segment := -1
+	_, count, err := readRecords(file, func(record walRecord) error {
+		if segment < 0 {
+			if record.Op != walSnapshot {
+				return errors.New("snapshot header missing")
+			}
+			segment = record.Segment
+			return nil
+		}
+		return apply(record)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("loading snapshot %s: %w", path, err)
+	}
+	if segment < 0 {
+		return 0, errors.New("snapshot " + path + " is empty")
+	}
+
+	logStuff(fmt.Sprintf("loaded snapshot of %d records", count-1))
+	return segment, nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Store is the storage engine behind the HTTP handlers. It covers contexts,
+// the entries inside them, tokens and the permissions granted to tokens.
+// Every implementation must be safe for concurrent use.
+type Store interface {
+	// createContext registers a new context and creates its data storage.
+	createContext(name string) error
+	// getContext returns the context name if it exists.
+	getContext(name string) (string, error)
+	// deleteContext removes a context together with all of its entries.
+	deleteContext(name string) error
+
+	// createEntry inserts a key-value pair at version 1 expiring at
+	// expiresAt, failing if the key already exists.
+	createEntry(context string, key string, value string, expiresAt int64) error
+	// getEntry returns the entry stored under key.
+	getEntry(context string, key string) (entry, error)
+	// updateEntry overwrites the value and the expiry time of an existing key
+	// and returns its new version. When expectedVersion isn't 0 the entry
+	// must be at that version, otherwise errVersionMismatch is returned.
+	updateEntry(context string, key string, value string, expiresAt int64, expectedVersion int64) (int64, error)
+	// deleteEntry removes an existing key. When expectedVersion isn't 0 the
+	// entry must be at that version, otherwise errVersionMismatch is returned.
+	deleteEntry(context string, key string, expectedVersion int64) error
+	// getEntries returns the entries stored under any of keys, by key. The
+	// missing keys are absent from the map.
+	getEntries(context string, keys []string) (map[string]entry, error)
+	// listEntries returns up to limit entries in lexical key order, keeping
+	// only the keys starting with prefix and sorting after the key after.
+	listEntries(context string, prefix string, after string, limit int) ([]entry, error)
+	// applyBatch runs the operations in order on a context, all of them or
+	// none: when one fails nothing is written and a *batchError is returned.
+	applyBatch(context string, ops []batchOp) ([]batchResult, error)
+	// reapExpired physically removes up to limit expired entries and returns
+	// the ones removed.
+	reapExpired(limit int) ([]entryRef, error)
+
+	// createToken generates a new token described by info and returns its
+	// secret.
+	createToken(info tokenInfo) (string, error)
+	// getToken checks if a token exists, returning errTokenExpired once it
+	// expired.
+	getToken(token string) error
+	// deleteToken removes a token and every permission granted to it.
+	deleteToken(token string) error
+	// createAdmToken creates the master admin token if none exists yet and
+	// returns its secret, or an empty string when one was already created.
+	// The secret is generated unless one is given. Existing master admin
+	// tokens are granted the admin permissions added since they were created.
+	createAdmToken(secret string) (string, error)
+	// resetAdmToken removes every master admin token, or every token holding
+	// an admin permission when allAdmins is set, and creates a new master
+	// admin token. It returns its secret, the number of tokens removed and the
+	// number of delegated admin tokens kept.
+	resetAdmToken(allAdmins bool) (string, int, int, error)
+	// getTokenInfo returns the metadata of a token.
+	getTokenInfo(token string) (tokenInfo, error)
+	// rotateToken replaces the token with ID id by a new one holding the same
+	// metadata and permissions, and returns the new token and its secret. The
+	// old token is removed, or expires after grace when grace isn't 0.
+	rotateToken(id string, grace time.Duration) (tokenInfo, string, error)
+	// listTokens returns the metadata of every token, oldest first.
+	listTokens() ([]tokenInfo, error)
+	// getTokenGrants returns every permission granted to the token with ID
+	// id.
+	getTokenGrants(id string) ([]tokenGrant, error)
+
+	// getTokenRoles returns the names of the roles held by the token with ID
+	// id.
+	getTokenRoles(id string) ([]string, error)
+
+	// createRole registers a new role without any permission.
+	createRole(name string) error
+	// deleteRole removes a role, taking it away from every token holding it.
+	deleteRole(name string) error
+	// listRoles returns every role with its permissions, by name.
+	listRoles() ([]role, error)
+	// grantRolePermission grants a permission to a role on a context
+	// pattern, for every token holding the role. When keyPrefix isn't empty
+	// the permission only covers the keys starting with it.
+	grantRolePermission(name string, permission string, pattern string, keyPrefix string) error
+	// revokeRolePermission revokes a permission of a role on a context
+	// pattern.
+	revokeRolePermission(name string, permission string, pattern string) error
+	// assignRole gives a role to the token with ID id.
+	assignRole(id string, name string) error
+	// unassignRole takes a role away from the token with ID id.
+	unassignRole(id string, name string) error
+
+	// grantTokenPermission grants a permission to a token on a context. When
+	// keyPrefix isn't empty the permission only covers the keys starting with
+	// it.
+	grantTokenPermission(token string, permission string, context string, keyPrefix string) error
+	// rovokeTokenPermission revokes a permission of a token on a context.
+	rovokeTokenPermission(token string, permission string, context string) error
+	// getPermission checks if the token of a credential holds a permission
+	// on a context, either its own or through one of its roles, returning
+	// errTokenExpired once the token expired.
+	getPermission(cred credential, context string, reqType string) error
+	// getGrants is getPermission returning the grants covering the context,
+	// which tell the keys the token can reach.
+	getGrants(cred credential, context string, reqType string) ([]tokenGrant, error)
+	// purgeExpiredTokens removes the expired tokens together with their
+	// permissions and returns how many were removed.
+	purgeExpiredTokens() (int, error)
+
+	// close releases the resources held by the store.
+	close() error
+}
+
+// entry is a key-value pair stored in a context. ExpiresAt is the expiry
+// time in unix milliseconds, or 0 when the entry never expires. Expired
+// entries are invisible to every read and write, even before they are
+// physically removed by the reaper. Version starts at 1 when the entry is
+// created and grows by one on every update.
+type entry struct {
+	Key       string
+	Value     string
+	ExpiresAt int64
+	Version   int64
+}
+
+// entryRef names an entry of a context.
+type entryRef struct {
+	Context string
+	Key     string
+}
+
+// contextNamePattern is the grammar of context names: 8 to 64 letters,
+// digits or _, starting with a letter.
+var contextNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{7,63}$`)
+
+// validateContextName checks a context name against contextNamePattern. The
+// stores check it when a context is created or looked up.
+func validateContextName(name string) error {
+	if !contextNamePattern.MatchString(name) {
+		return errors.New("a context name must have 8 to 64 letters, digits or _, starting with a letter")
+	}
+	return nil
+}
+
+// errVersionMismatch is returned by conditional writes when the entry is not
+// at the expected version.
+var errVersionMismatch = errors.New("version mismatch")
+
+// expired reports whether an entry expiring at expiresAt is expired at now.
+func expired(expiresAt int64, now int64) bool {
+	return expiresAt != 0 && expiresAt <= now
+}
+
+// prefixEnd returns the smallest string sorting after every string starting
+// with prefix. There is none when the prefix is empty or only made of 0xff
+// bytes.
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// Operations of a batch.
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+	batchGet    = "get"
+)
+
+// batchOp is one operation of a batch. Version, when not 0, is the version
+// the entry must be at for the whole batch to apply.
+type batchOp struct {
+	Op        string
+	Key       string
+	Value     string
+	ExpiresAt int64
+	Version   int64
+}
+
+// batchResult is the outcome of one operation of a batch. Entry is the entry
+// as written by a create or an update, and as found by a get or a delete.
+type batchResult struct {
+	Op    string
+	Key   string
+	Found bool
+	Entry entry
+}
+
+// batchError tells which operation made a batch fail.
+type batchError struct {
+	index int
+	err   error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("operation %d: %s", e.index, e.err.Error())
+}
+
+func (e *batchError) Unwrap() error {
+	return e.err
+}
+
+// checkBatchOp checks that an operation can apply to the entry currently
+// stored under its key, if found.
+func checkBatchOp(context string, op batchOp, current entry, found bool) error {
+	switch {
+	case op.Op == batchCreate && found:
+		return errors.New("key already exists")
+	case op.Op == batchGet && !found && op.Version == 0:
+		return nil
+	case op.Op == batchGet && !found:
+		return errNoEntry(context, op.Key)
+	case op.Op != batchCreate && !found:
+		return errors.New("key-value pair doesn't exists")
+	case op.Version != 0 && current.Version != op.Version:
+		return errVersionMismatch
+	}
+	return nil
+}
+
+// tokenInfo is the metadata of a token: a generated ID that can be shown
+// where the secret never is, the name and labels telling who owns it, its
+// creation time, its expiry time and the last time it was used, all in unix
+// milliseconds. ExpiresAt is 0 when the token never expires and LastUsedAt
+// when it was never used. LastUsedAt is only recorded every
+// tokenUseResolution, so using a token doesn't write every time.
+type tokenInfo struct {
+	ID         string
+	Name       string
+	Labels     map[string]string
+	CreatedAt  int64
+	ExpiresAt  int64
+	LastUsedAt int64
+}
+
+// tokenUseResolution is how precise the last use time of tokens is.
+const tokenUseResolution = time.Minute
+
+// tokenGrant is a permission granted to a token on a context, limited to the
+// keys starting with KeyPrefix when it isn't empty.
+type tokenGrant struct {
+	Permission string
+	Context    string
+	KeyPrefix  string
+}
+
+// rotatedExpiry returns when a token expiring at expiresAt expires once
+// rotated with a grace period, 0 when it has to be removed right away.
+func rotatedExpiry(expiresAt int64, grace time.Duration) int64 {
+	if grace == 0 {
+		return 0
+	}
+	graceEnd := time.Now().Add(grace).UnixMilli()
+	if expiresAt != 0 && expiresAt < graceEnd {
+		return expiresAt
+	}
+	return graceEnd
+}
+
+// sortGrants orders grants by context, then by permission and then by key
+// prefix.
+func sortGrants(grants []tokenGrant) {
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Context != grants[j].Context {
+			return grants[i].Context < grants[j].Context
+		}
+		if grants[i].Permission != grants[j].Permission {
+			return grants[i].Permission < grants[j].Permission
+		}
+		return grants[i].KeyPrefix < grants[j].KeyPrefix
+	})
+}
+
+// errNoToken is returned when no token has the ID asked for.
+var errNoToken = errors.New("token does not exist")
+
+// newTokenInfo describes a token created now.
+func newTokenInfo(name string, labels map[string]string, expiresAt int64) tokenInfo {
+	return tokenInfo{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Labels:    labels,
+		CreatedAt: time.Now().UnixMilli(),
+		ExpiresAt: expiresAt,
+	}
+}
+
+// legacyTokenID derives the ID of a token created before tokens had one from
+// its hash, so it is the same every time it is computed.
+func legacyTokenID(tokenSha string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(tokenSha)).String()
+}
+
+// errTokenExpired is returned when an expired token is used.
+var errTokenExpired = errors.New("token expired")
+
+// admPermissions lists every permission granted to the master admin token.
+var admPermissions = []string{
+	"ADM_TOKEN_POST",
+	"ADM_TOKEN_GET",
+	"ADM_TOKEN_ROTATE",
+	"ADM_TOKEN_DELETE",
+	"ADM_TOKEN_GRANT",
+	"ADM_TOKEN_REVOKE",
+	"ADM_CONTEXT_POST",
+	"ADM_CONTEXT_GET",
+	"ADM_CONTEXT_DELETE",
+	"ADM_ROLE_POST",
+	"ADM_ROLE_GET",
+	"ADM_ROLE_DELETE",
+	"ADM_ROLE_GRANT",
+	"ADM_ROLE_REVOKE",
+	"ADM_AUDIT_GET",
+}
+
+// masterAdmPermissions are the admin permissions the master admin token held
+// from the start. A token holding all of them on "ALL" is a master admin
+// token, while delegated admin tokens hold a part of admPermissions only.
+var masterAdmPermissions = []string{
+	"ADM_TOKEN_POST",
+	"ADM_TOKEN_DELETE",
+	"ADM_TOKEN_GRANT",
+	"ADM_TOKEN_REVOKE",
+	"ADM_CONTEXT_POST",
+	"ADM_CONTEXT_GET",
+	"ADM_CONTEXT_DELETE",
+}
+
+// isMasterAdm reports whether grants hold every one of masterAdmPermissions on
+// "ALL".
+func isMasterAdm(grants []tokenGrant) bool {
+	for _, permission := range masterAdmPermissions {
+		held := false
+		for _, grant := range grants {
+			if grant.Permission == permission && grant.Context == "ALL" {
+				held = true
+				break
+			}
+		}
+		if !held {
+			return false
+		}
+	}
+	return true
+}
+
+// isAdmPermission reports whether permission is one of admPermissions.
+func isAdmPermission(permission string) bool {
+	for _, admPermission := range admPermissions {
+		if permission == admPermission {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultDBPath is the SQLite database file. The other data files are kept
+// next to it: the write-ahead log rebuilding the memory store and its latest
+// snapshot, named after it, and admTokenFileName, where a generated master
+// admin token is written.
+const (
+	defaultDBPath    = "./db.sqlite3"
+	admTokenFileName = "admin-token"
+)
+
+// storeOptions configures the storage engine opened by openStore.
+type storeOptions struct {
+	kind             string
+	dbPath           string
+	busyTimeout      time.Duration
+	maxConns         int
+	walFsync         string
+	snapshotInterval time.Duration
+	// changes is the hub the changes to entries are published to, nil when
+	// nothing watches them.
+	changes *changeHub
+}
+
+// walPath returns the write-ahead log of the memory store.
+func (o storeOptions) walPath() string {
+	return strings.TrimSuffix(o.dbPath, filepath.Ext(o.dbPath)) + ".wal"
+}
+
+// snapshotPath returns the latest snapshot of the memory store.
+func (o storeOptions) snapshotPath() string {
+	return strings.TrimSuffix(o.dbPath, filepath.Ext(o.dbPath)) + ".snapshot"
+}
+
+// admTokenPath returns where a generated master admin token is written.
+func (o storeOptions) admTokenPath() string {
+	return filepath.Join(filepath.Dir(o.dbPath), admTokenFileName)
+}
+
+// openStore opens the storage engine named by o.kind. The SQLite store shares
+// one pool of at most o.maxConns connections, waiting o.busyTimeout for the
+// database to be unlocked. The memory store replays its write-ahead log,
+// fsynced according to o.walFsync, and snapshots itself every
+// o.snapshotInterval unless it is zero.
+func openStore(o storeOptions) (Store, error) {
+	switch o.kind {
+	case "sqlite":
+		return openSQLiteStore(o.dbPath, o.busyTimeout, o.maxConns, o.changes)
+	case "memory":
+		policy, err := parseFsyncPolicy(o.walFsync)
+		if err != nil {
+			return nil, err
+		}
+		s, err := openMemStore(o.walPath(), o.snapshotPath(), policy, o.changes)
+		if err != nil {
+			return nil, err
+		}
+		if o.snapshotInterval > 0 {
+			s.startSnapshots(o.snapshotInterval)
+		}
+		return s, nil
+	}
+	return nil, errors.New("unknown store " + o.kind + ", use sqlite or memory")
+}
+
+// errNoEntry is the error returned when a key is missing from a context.
+func errNoEntry(context string, key string) error {
+	return fmt.Errorf("no entry found for key: %s in context: %s", key, context)
+}
@@ -0,0 +1,1146 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// permissionKey identifies a permission granted to a token on a context. The
+// maps keyed by it hold the key prefixes the permission is granted with, one
+// grant each.
+type permissionKey struct {
+	permission string
+	context    string
+}
+
+// memStore is the Store keeping everything in concurrent in-memory hashmaps.
+// Tokens are kept as SHA-256 hashes, exactly like in the SQLite tables.
+//
+// Every method validates a mutation first and then hands it to commit, which
+// writes it to the write-ahead log (when there is one) before applying it, so
+// replaying the log through apply rebuilds the same state after a reboot.
+// The changes to entries are published to changes once committed, before the
+// lock is released. The last use of tokens is only kept in memory, and
+// logged by flushTokenUses before each snapshot and when the store closes.
+type memStore struct {
+	mu          sync.RWMutex
+	wal         *writeAheadLog
+	changes     *changeHub
+	snapshotMu  sync.Mutex
+	snapshotTo  string
+	stop        chan struct{}
+	done        chan struct{}
+	contexts    map[string]map[string]entry
+	keys        map[string][]string
+	expiries    expiryHeap
+	tokens      map[string]tokenInfo
+	permissions map[string]map[permissionKey][]string
+	roles       map[string]map[permissionKey][]string
+	tokenRoles  map[string]map[string]struct{}
+	usedTokens  map[string]struct{}
+}
+
+// newMemStore returns an empty in-memory store.
+func newMemStore() *memStore {
+	return &memStore{
+		contexts:    make(map[string]map[string]entry),
+		keys:        make(map[string][]string),
+		tokens:      make(map[string]tokenInfo),
+		permissions: make(map[string]map[permissionKey][]string),
+		roles:       make(map[string]map[permissionKey][]string),
+		tokenRoles:  make(map[string]map[string]struct{}),
+		usedTokens:  make(map[string]struct{}),
+	}
+}
+
+// openMemStore rebuilds the in-memory store from the latest snapshot and the
+// write-ahead log segments after it, and keeps logging every new mutation to
+// walPath. Snapshots are written to snapshotPath, and the new changes to
+// entries published to changes.
+func openMemStore(walPath string, snapshotPath string, policy fsyncPolicy, changes *changeHub) (*memStore, error) {
+	s := newMemStore()
+	s.snapshotTo = snapshotPath
+
+	segments, err := listSegments(walPath)
+	if err != nil {
+		return nil, err
+	}
+	// A log written before it was split in segments becomes the first segment.
+	if _, err := os.Stat(walPath); err == nil && len(segments) == 0 {
+		if err := os.Rename(walPath, segmentPath(walPath, 1)); err != nil {
+			return nil, err
+		}
+		segments = []int{1}
+	}
+
+	first, err := loadSnapshot(snapshotPath, s.apply)
+	if err != nil {
+		return nil, err
+	}
+
+	last := max(first, 1)
+	for i, segment := range segments {
+		if segment < first {
+			continue
+		}
+		if err := replayWAL(segmentPath(walPath, segment), i == len(segments)-1, s.apply); err != nil {
+			return nil, err
+		}
+		last = segment
+	}
+
+	s.wal, err = openWAL(walPath, last, policy)
+	if err != nil {
+		return nil, err
+	}
+	// Segments already covered by the snapshot are leftovers of an
+	// interrupted compaction.
+	if err := s.wal.removeSegmentsBefore(first); err != nil {
+		return nil, err
+	}
+	s.changes = changes
+	return s, nil
+}
+
+// startSnapshots writes a snapshot every interval until the store is closed.
+func (s *memStore) startSnapshots(interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.snapshot(); err != nil {
+					logStuff("error on writing snapshot: " + err.Error())
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// snapshot writes a point-in-time snapshot of the store and then compacts
+// away the log segments it covers. Nothing is written if the log did not
+// change since the last snapshot.
+func (s *memStore) snapshot() error {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	if err := s.flushTokenUses(); err != nil {
+		return err
+	}
+	if !s.wal.hasWritten() {
+		return nil
+	}
+
+	// Holding the read lock keeps writers out, so the records copied here
+	// are exactly the state before the first record of the new segment.
+	s.mu.RLock()
+	segment, err := s.wal.rotate()
+	if err != nil {
+		s.mu.RUnlock()
+		return err
+	}
+	records := s.snapshotRecords()
+	s.mu.RUnlock()
+
+	if err := writeSnapshot(s.snapshotTo, segment, records); err != nil {
+		return err
+	}
+	return s.wal.removeSegmentsBefore(segment)
+}
+
+// snapshotRecords returns the records rebuilding the current state; the
+// caller must hold the lock.
+func (s *memStore) snapshotRecords() []walRecord {
+	var records []walRecord
+	for context, entries := range s.contexts {
+		records = append(records, walRecord{Op: walCreateContext, Context: context})
+		for key, e := range entries {
+			records = append(records, walRecord{Op: walCreateEntry, Context: context, Key: key, Value: e.Value, ExpiresAt: e.ExpiresAt, Version: e.Version})
+		}
+	}
+	for tokenSha, info := range s.tokens {
+		records = append(records, createTokenRecord(tokenSha, info))
+	}
+	for tokenSha, granted := range s.permissions {
+		for perm, keyPrefixes := range granted {
+			for _, keyPrefix := range keyPrefixes {
+				records = append(records, walRecord{Op: walGrantToken, Token: tokenSha, Permission: perm.permission, Context: perm.context, KeyPrefix: keyPrefix})
+			}
+		}
+	}
+	for name, granted := range s.roles {
+		records = append(records, walRecord{Op: walCreateRole, Role: name})
+		for perm, keyPrefixes := range granted {
+			for _, keyPrefix := range keyPrefixes {
+				records = append(records, walRecord{Op: walGrantRole, Role: name, Permission: perm.permission, Context: perm.context, KeyPrefix: keyPrefix})
+			}
+		}
+	}
+	for tokenSha, held := range s.tokenRoles {
+		for name := range held {
+			records = append(records, walRecord{Op: walAssignRole, Token: tokenSha, Role: name})
+		}
+	}
+	return records
+}
+
+// commit logs the records and then applies them; the caller must hold the
+// write lock. Nothing is applied if the log cannot be written. Several
+// records are logged as a single batch record, so a torn write can never
+// leave half of them in the log.
+func (s *memStore) commit(records ...walRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	record := records[0]
+	if len(records) > 1 {
+		record = walRecord{Op: walBatch, Records: records}
+	}
+
+	if s.wal != nil {
+		if err := s.wal.append(record); err != nil {
+			logStuff("error on writing wal: " + err.Error())
+			return err
+		}
+	}
+	return s.apply(record)
+}
+
+// apply performs a mutation without any validation.
+func (s *memStore) apply(record walRecord) error {
+	switch record.Op {
+	case walBatch:
+		for _, nested := range record.Records {
+			if err := s.apply(nested); err != nil {
+				return err
+			}
+		}
+	case walCreateContext:
+		s.contexts[record.Context] = make(map[string]entry)
+		s.keys[record.Context] = nil
+	case walDeleteContext:
+		delete(s.contexts, record.Context)
+		delete(s.keys, record.Context)
+	case walCreateEntry, walUpdateEntry:
+		entries, ok := s.contexts[record.Context]
+		if !ok {
+			return fmt.Errorf("no context : %s", record.Context)
+		}
+		version := record.Version
+		// Records logged before entries had versions.
+		if version == 0 {
+			version = entries[record.Key].Version + 1
+			if record.Op == walCreateEntry {
+				version = 1
+			}
+		}
+		if _, ok := entries[record.Key]; !ok {
+			i, _ := slices.BinarySearch(s.keys[record.Context], record.Key)
+			s.keys[record.Context] = slices.Insert(s.keys[record.Context], i, record.Key)
+		}
+		entries[record.Key] = entry{Key: record.Key, Value: record.Value, ExpiresAt: record.ExpiresAt, Version: version}
+		if record.ExpiresAt != 0 {
+			heap.Push(&s.expiries, expiryItem{record.ExpiresAt, record.Context, record.Key})
+		}
+	case walDeleteEntry:
+		if _, ok := s.contexts[record.Context][record.Key]; ok {
+			i, _ := slices.BinarySearch(s.keys[record.Context], record.Key)
+			s.keys[record.Context] = slices.Delete(s.keys[record.Context], i, i+1)
+		}
+		delete(s.contexts[record.Context], record.Key)
+	case walCreateToken:
+		info := tokenInfo{ID: record.TokenID, Name: record.Name, Labels: record.Labels, CreatedAt: record.CreatedAt, ExpiresAt: record.ExpiresAt, LastUsedAt: record.LastUsedAt}
+		// Records logged before tokens had an ID.
+		if info.ID == "" {
+			info.ID = legacyTokenID(record.Token)
+		}
+		s.tokens[record.Token] = info
+	case walExpireToken:
+		if info, ok := s.tokens[record.Token]; ok {
+			info.ExpiresAt = record.ExpiresAt
+			s.tokens[record.Token] = info
+		}
+	case walUseToken:
+		if info, ok := s.tokens[record.Token]; ok {
+			info.LastUsedAt = record.LastUsedAt
+			s.tokens[record.Token] = info
+		}
+	case walDeleteToken:
+		delete(s.permissions, record.Token)
+		delete(s.tokenRoles, record.Token)
+		delete(s.tokens, record.Token)
+	case walGrantToken:
+		granted, ok := s.permissions[record.Token]
+		if !ok {
+			granted = make(map[permissionKey][]string)
+			s.permissions[record.Token] = granted
+		}
+		perm := permissionKey{record.Permission, record.Context}
+		if !slices.Contains(granted[perm], record.KeyPrefix) {
+			granted[perm] = append(granted[perm], record.KeyPrefix)
+		}
+	case walRevokeToken:
+		delete(s.permissions[record.Token], permissionKey{record.Permission, record.Context})
+	case walCreateRole:
+		s.roles[record.Role] = make(map[permissionKey][]string)
+	case walDeleteRole:
+		delete(s.roles, record.Role)
+		for _, held := range s.tokenRoles {
+			delete(held, record.Role)
+		}
+	case walGrantRole:
+		granted, ok := s.roles[record.Role]
+		if !ok {
+			return errors.New("no role " + record.Role)
+		}
+		perm := permissionKey{record.Permission, record.Context}
+		if !slices.Contains(granted[perm], record.KeyPrefix) {
+			granted[perm] = append(granted[perm], record.KeyPrefix)
+		}
+	case walRevokeRole:
+		delete(s.roles[record.Role], permissionKey{record.Permission, record.Context})
+	case walAssignRole:
+		held, ok := s.tokenRoles[record.Token]
+		if !ok {
+			held = make(map[string]struct{})
+			s.tokenRoles[record.Token] = held
+		}
+		held[record.Role] = struct{}{}
+	case walUnassignRole:
+		delete(s.tokenRoles[record.Token], record.Role)
+	default:
+		return errors.New("unknown operation " + record.Op)
+	}
+	return nil
+}
+
+func (s *memStore) createContext(name string) error {
+	err := validateContextName(name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The SQLite store keeps context names unique whatever their case, so does this one.
+	for existing := range s.contexts {
+		if strings.EqualFold(existing, name) {
+			logStuff("error on creating context " + name)
+			return errors.New("context already exists")
+		}
+	}
+	logStuff("creating context " + name)
+	return s.commit(walRecord{Op: walCreateContext, Context: name})
+}
+
+func (s *memStore) getContext(name string) (string, error) {
+	err := validateContextName(name)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.contexts[name]; !ok {
+		logStuff("error on returning context " + name)
+		return "", fmt.Errorf("no context : %s", name)
+	}
+	return name, nil
+}
+
+func (s *memStore) deleteContext(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.contexts[name]; !ok {
+		logStuff("error on deleting context " + name)
+		return errors.New("context doesn't exists")
+	}
+	logStuff("deleting context " + name)
+	return s.commit(walRecord{Op: walDeleteContext, Context: name})
+}
+
+func (s *memStore) createEntry(context string, key string, value string, expiresAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, ok := s.contexts[context]
+	if !ok {
+		return fmt.Errorf("no context : %s", context)
+	}
+	if e, ok := entries[key]; ok && !expired(e.ExpiresAt, time.Now().UnixMilli()) {
+		logStuff("error on creating entry " + key + " on context: " + context)
+		return errors.New("key already exists")
+	}
+	err := s.commit(walRecord{Op: walCreateEntry, Context: context, Key: key, Value: value, ExpiresAt: expiresAt, Version: 1})
+	if err != nil {
+		return err
+	}
+	s.changes.publish(changeEvent{Op: changeCreate, Context: context, Key: key, Value: value, Version: 1, ExpiresAt: expiresAt})
+	return nil
+}
+
+// lookupLocked returns the unexpired entry stored under key; the caller must
+// hold the lock.
+func (s *memStore) lookupLocked(context string, key string) (entry, bool) {
+	e, ok := s.contexts[context][key]
+	if !ok || expired(e.ExpiresAt, time.Now().UnixMilli()) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (s *memStore) getEntry(context string, key string) (entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.lookupLocked(context, key)
+	if !ok {
+		return entry{}, errNoEntry(context, key)
+	}
+	return e, nil
+}
+
+func (s *memStore) getEntries(context string, keys []string) (map[string]entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make(map[string]entry, len(keys))
+	for _, key := range keys {
+		if e, ok := s.lookupLocked(context, key); ok {
+			entries[key] = e
+		}
+	}
+	return entries, nil
+}
+
+func (s *memStore) updateEntry(context string, key string, value string, expiresAt int64, expectedVersion int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookupLocked(context, key)
+	if !ok {
+		logStuff("error on updating entry " + key + " on context :" + context)
+		return 0, errors.New("key-value pair doesn't exists")
+	}
+	if expectedVersion != 0 && e.Version != expectedVersion {
+		logStuff("error on updating entry " + key + " on context :" + context)
+		return 0, errVersionMismatch
+	}
+	version := e.Version + 1
+	err := s.commit(walRecord{Op: walUpdateEntry, Context: context, Key: key, Value: value, ExpiresAt: expiresAt, Version: version})
+	if err != nil {
+		return 0, err
+	}
+	s.changes.publish(changeEvent{Op: changeUpdate, Context: context, Key: key, Value: value, Version: version, ExpiresAt: expiresAt})
+	return version, nil
+}
+
+func (s *memStore) deleteEntry(context string, key string, expectedVersion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookupLocked(context, key)
+	if !ok {
+		logStuff("error on deleting entry " + key + " from context " + context)
+		return errors.New("key-value pair doesn't exists")
+	}
+	if expectedVersion != 0 && e.Version != expectedVersion {
+		logStuff("error on deleting entry " + key + " from context " + context)
+		return errVersionMismatch
+	}
+	err := s.commit(walRecord{Op: walDeleteEntry, Context: context, Key: key})
+	if err != nil {
+		return err
+	}
+	s.changes.publish(changeEvent{Op: changeDelete, Context: context, Key: key})
+	return nil
+}
+
+func (s *memStore) listEntries(context string, prefix string, after string, limit int) ([]entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, ok := s.contexts[context]
+	if !ok {
+		return nil, fmt.Errorf("no context : %s", context)
+	}
+	// The keys are kept sorted, so the page starts at the first key both
+	// after the cursor and starting with the prefix.
+	keys := s.keys[context]
+	start, _ := slices.BinarySearch(keys, prefix)
+	if i, found := slices.BinarySearch(keys, after); found {
+		start = max(start, i+1)
+	} else {
+		start = max(start, i)
+	}
+	now := time.Now().UnixMilli()
+	var list []entry
+	for _, key := range keys[start:] {
+		if len(list) == limit || !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if e := entries[key]; !expired(e.ExpiresAt, now) {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+func (s *memStore) applyBatch(context string, ops []batchOp) ([]batchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, ok := s.contexts[context]
+	if !ok {
+		return nil, fmt.Errorf("no context : %s", context)
+	}
+
+	// pending holds the entries as left by the operations already validated,
+	// nil for the deleted ones, so every operation sees the earlier ones.
+	now := time.Now().UnixMilli()
+	pending := make(map[string]*entry)
+	lookup := func(key string) (entry, bool) {
+		if e, ok := pending[key]; ok {
+			if e == nil {
+				return entry{}, false
+			}
+			return *e, true
+		}
+		e, ok := entries[key]
+		if !ok || expired(e.ExpiresAt, now) {
+			return entry{}, false
+		}
+		return e, true
+	}
+
+	var records []walRecord
+	results := make([]batchResult, 0, len(ops))
+	for i, op := range ops {
+		current, found := lookup(op.Key)
+		if err := checkBatchOp(context, op, current, found); err != nil {
+			return nil, &batchError{index: i, err: err}
+		}
+
+		result := batchResult{Op: op.Op, Key: op.Key, Found: found, Entry: current}
+		switch op.Op {
+		case batchCreate, batchUpdate:
+			e := entry{Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt, Version: current.Version + 1}
+			walOp := walUpdateEntry
+			if op.Op == batchCreate {
+				e.Version = 1
+				walOp = walCreateEntry
+			}
+			pending[op.Key] = &e
+			records = append(records, walRecord{Op: walOp, Context: context, Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt, Version: e.Version})
+			result.Entry = e
+		case batchDelete:
+			pending[op.Key] = nil
+			records = append(records, walRecord{Op: walDeleteEntry, Context: context, Key: op.Key})
+		}
+		results = append(results, result)
+	}
+
+	if err := s.commit(records...); err != nil {
+		return nil, err
+	}
+	// Watchers get every write of the batch at once.
+	s.changes.publish(batchEvents(context, results)...)
+	logStuff(fmt.Sprintf("applied batch of %d operations on context %s", len(ops), context))
+	return results, nil
+}
+
+func (s *memStore) reapExpired(limit int) ([]entryRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The heap may hold items for entries that were since deleted, updated
+	// or recreated; only those still matching the stored entry are removed.
+	now := time.Now().UnixMilli()
+	var records []walRecord
+	var reaped []entryRef
+	for len(records) < limit && len(s.expiries) > 0 && s.expiries[0].expiresAt <= now {
+		item := heap.Pop(&s.expiries).(expiryItem)
+		e, ok := s.contexts[item.context][item.key]
+		if ok && e.ExpiresAt == item.expiresAt {
+			records = append(records, walRecord{Op: walDeleteEntry, Context: item.context, Key: item.key})
+			reaped = append(reaped, entryRef{Context: item.context, Key: item.key})
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	logStuff(fmt.Sprintf("reaping %d expired entries", len(records)))
+	if err := s.commit(records...); err != nil {
+		return nil, err
+	}
+	s.changes.publish(expiryEvents(reaped)...)
+	return reaped, nil
+}
+
+func (s *memStore) createToken(info tokenInfo) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newUUID := uuid.New().String()
+	logStuff("creating token " + info.ID)
+	return newUUID, s.commit(createTokenRecord(tokenToSha256(newUUID), info))
+}
+
+// createTokenRecord is the record creating the token hashed to tokenSha.
+func createTokenRecord(tokenSha string, info tokenInfo) walRecord {
+	return walRecord{Op: walCreateToken, Token: tokenSha, TokenID: info.ID, Name: info.Name, Labels: info.Labels, CreatedAt: info.CreatedAt, ExpiresAt: info.ExpiresAt, LastUsedAt: info.LastUsedAt}
+}
+
+func (s *memStore) getToken(token string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, ok := s.tokens[tokenToSha256(token)]
+	if !ok {
+		logStuff("error on checking if token exists")
+		return errors.New("token does not exist")
+	}
+	if expired(info.ExpiresAt, time.Now().UnixMilli()) {
+		logStuff("error on checking if token exists, token " + info.ID + " expired")
+		return errTokenExpired
+	}
+	return nil
+}
+
+func (s *memStore) deleteToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokenSha := tokenToSha256(token)
+	if _, ok := s.tokens[tokenSha]; !ok {
+		logStuff("error on deleting token")
+		return errors.New("token doesn't exist")
+	}
+	logStuff("deleting token")
+	return s.commit(walRecord{Op: walDeleteToken, Token: tokenSha})
+}
+
+func (s *memStore) createAdmToken(secret string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Master admin tokens get the admin permissions they miss.
+	masters := s.masterTokensLocked()
+	var missing []walRecord
+	for _, tokenSha := range masters {
+		granted := s.permissions[tokenSha]
+		for _, permission := range admPermissions {
+			if _, ok := granted[permissionKey{permission, "ALL"}]; !ok {
+				missing = append(missing, walRecord{Op: walGrantToken, Token: tokenSha, Permission: permission, Context: "ALL"})
+			}
+		}
+	}
+	if len(missing) > 0 {
+		logStuff(fmt.Sprintf("granting %d missing permissions to adm tokens", len(missing)))
+		if err := s.commit(missing...); err != nil {
+			return "", err
+		}
+	}
+
+	if len(masters) > 0 {
+		return "", nil
+	}
+
+	if secret == "" {
+		secret = uuid.New().String()
+	}
+	logStuff("creating adm token")
+	return secret, s.commit(admTokenRecords(secret)...)
+}
+
+func (s *memStore) resetAdmToken(allAdmins bool) (string, int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	admins := s.adminTokensLocked()
+	removed := s.masterTokensLocked()
+	if allAdmins {
+		removed = admins
+	}
+	var records []walRecord
+	for _, tokenSha := range removed {
+		records = append(records, walRecord{Op: walDeleteToken, Token: tokenSha})
+	}
+	newUUID := uuid.New().String()
+	records = append(records, admTokenRecords(newUUID)...)
+	logStuff(fmt.Sprintf("replacing %d adm tokens by a new one", len(removed)))
+	return newUUID, len(removed), len(admins) - len(removed), s.commit(records...)
+}
+
+// admTokenRecords returns the records creating a master admin token with the
+// given secret.
+func admTokenRecords(secret string) []walRecord {
+	tokenSha := tokenToSha256(secret)
+	records := []walRecord{createTokenRecord(tokenSha, newTokenInfo("admin", nil, 0))}
+	for _, permission := range admPermissions {
+		records = append(records, walRecord{Op: walGrantToken, Token: tokenSha, Permission: permission, Context: "ALL"})
+	}
+	return records
+}
+
+// masterTokensLocked returns the hashes of the master admin tokens, those
+// holding every one of masterAdmPermissions on "ALL"; the caller must hold
+// the lock.
+func (s *memStore) masterTokensLocked() []string {
+	var masters []string
+	for tokenSha, granted := range s.permissions {
+		master := true
+		for _, permission := range masterAdmPermissions {
+			if _, ok := granted[permissionKey{permission, "ALL"}]; !ok {
+				master = false
+				break
+			}
+		}
+		if master {
+			masters = append(masters, tokenSha)
+		}
+	}
+	return masters
+}
+
+// adminTokensLocked returns the hashes of the tokens holding any admin
+// permission, master and delegated admin tokens alike; the caller must hold
+// the lock.
+func (s *memStore) adminTokensLocked() []string {
+	var admins []string
+	for tokenSha, granted := range s.permissions {
+		for key := range granted {
+			if slices.Contains(admPermissions, key.permission) {
+				admins = append(admins, tokenSha)
+				break
+			}
+		}
+	}
+	return admins
+}
+
+func (s *memStore) grantTokenPermission(token string, permission string, context string, keyPrefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokenSha := tokenToSha256(token)
+	if slices.Contains(s.permissions[tokenSha][permissionKey{permission, context}], keyPrefix) {
+		logStuff("error on granting permission on context " + context + " for token")
+		return errors.New("permission already granted")
+	}
+	logStuff("granting permission on context " + context + " for token")
+	return s.commit(walRecord{Op: walGrantToken, Token: tokenSha, Permission: permission, Context: context, KeyPrefix: keyPrefix})
+}
+
+func (s *memStore) rovokeTokenPermission(token string, permission string, context string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logStuff("revoking permission of a token from the context " + context)
+	return s.commit(walRecord{Op: walRevokeToken, Token: tokenToSha256(token), Permission: permission, Context: context})
+}
+
+func (s *memStore) getPermission(cred credential, context string, reqType string) error {
+	_, err := s.getGrants(cred, context, reqType)
+	return err
+}
+
+func (s *memStore) getGrants(cred credential, context string, reqType string) ([]tokenGrant, error) {
+	tokenSha, info, grants, err := s.checkPermission(cred, context, reqType)
+	if err != nil {
+		return nil, err
+	}
+	s.useToken(tokenSha, info)
+	return grants, nil
+}
+
+// checkPermission checks if the token of a credential holds a permission on
+// a context and returns its hash, its metadata and the grants covering the
+// context.
+func (s *memStore) checkPermission(cred credential, context string, reqType string) (string, tokenInfo, []tokenGrant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokenSha := s.credentialShaLocked(cred)
+	info := s.tokens[tokenSha]
+	cred.resolve(info.ID)
+	if expired(info.ExpiresAt, time.Now().UnixMilli()) {
+		logStuff("error on checking permission for context " + context + ", token " + info.ID + " expired")
+		return "", tokenInfo{}, nil, errTokenExpired
+	}
+	grants := matchingGrants(s.grantsLocked(tokenSha), reqType, context)
+	if len(grants) == 0 {
+		logStuff("error on checking permission for context " + context)
+		return "", tokenInfo{}, nil, errors.New("not authorized")
+	}
+	return tokenSha, info, grants, nil
+}
+
+// credentialShaLocked returns the hash the token of a credential is stored
+// under, empty when no token has its ID; the caller must hold the lock.
+func (s *memStore) credentialShaLocked(cred credential) string {
+	if cred.tokenID == "" {
+		return tokenToSha256(cred.secret)
+	}
+	for tokenSha, info := range s.tokens {
+		if info.ID == cred.tokenID {
+			return tokenSha
+		}
+	}
+	return ""
+}
+
+// grantsLocked returns the grants of the token hashed to tokenSha, both its
+// own and those of its roles; the caller must hold the lock.
+func (s *memStore) grantsLocked(tokenSha string) []tokenGrant {
+	var grants []tokenGrant
+	for perm, keyPrefixes := range s.permissions[tokenSha] {
+		for _, keyPrefix := range keyPrefixes {
+			grants = append(grants, tokenGrant{Permission: perm.permission, Context: perm.context, KeyPrefix: keyPrefix})
+		}
+	}
+	for name := range s.tokenRoles[tokenSha] {
+		for perm, keyPrefixes := range s.roles[name] {
+			for _, keyPrefix := range keyPrefixes {
+				grants = append(grants, tokenGrant{Permission: perm.permission, Context: perm.context, KeyPrefix: keyPrefix})
+			}
+		}
+	}
+	return grants
+}
+
+// useToken records that the token hashed to tokenSha was just used, unless
+// it already was within tokenUseResolution. The use is only kept in memory
+// until flushTokenUses logs it, so reads don't write to the log.
+func (s *memStore) useToken(tokenSha string, info tokenInfo) {
+	now := time.Now()
+	if now.Sub(time.UnixMilli(info.LastUsedAt)) < tokenUseResolution {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.tokens[tokenSha]
+	if !ok {
+		return
+	}
+	info.LastUsedAt = now.UnixMilli()
+	s.tokens[tokenSha] = info
+	s.usedTokens[tokenSha] = struct{}{}
+}
+
+// flushTokenUses logs the last use of the tokens used since the previous
+// flush, in a single record.
+func (s *memStore) flushTokenUses() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flushTokenUsesLocked()
+}
+
+// flushTokenUsesLocked is flushTokenUses for a caller holding the lock.
+func (s *memStore) flushTokenUsesLocked() error {
+	var records []walRecord
+	for tokenSha := range s.usedTokens {
+		if info, ok := s.tokens[tokenSha]; ok {
+			records = append(records, walRecord{Op: walUseToken, Token: tokenSha, LastUsedAt: info.LastUsedAt})
+		}
+	}
+	if err := s.commit(records...); err != nil {
+		logStuff("error on recording the use of tokens")
+		return err
+	}
+	clear(s.usedTokens)
+	return nil
+}
+
+func (s *memStore) getTokenInfo(token string) (tokenInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, ok := s.tokens[tokenToSha256(token)]
+	if !ok {
+		return tokenInfo{}, errNoToken
+	}
+	return info, nil
+}
+
+func (s *memStore) rotateToken(id string, grace time.Duration) (tokenInfo, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for oldSha, old := range s.tokens {
+		if old.ID != id {
+			continue
+		}
+		if expired(old.ExpiresAt, time.Now().UnixMilli()) {
+			return tokenInfo{}, "", errTokenExpired
+		}
+
+		newUUID := uuid.New().String()
+		tokenSha := tokenToSha256(newUUID)
+		info := newTokenInfo(old.Name, old.Labels, old.ExpiresAt)
+		records := []walRecord{createTokenRecord(tokenSha, info)}
+		for perm, keyPrefixes := range s.permissions[oldSha] {
+			for _, keyPrefix := range keyPrefixes {
+				records = append(records, walRecord{Op: walGrantToken, Token: tokenSha, Permission: perm.permission, Context: perm.context, KeyPrefix: keyPrefix})
+			}
+		}
+		for name := range s.tokenRoles[oldSha] {
+			records = append(records, walRecord{Op: walAssignRole, Token: tokenSha, Role: name})
+		}
+		if expiresAt := rotatedExpiry(old.ExpiresAt, grace); expiresAt != 0 {
+			records = append(records, walRecord{Op: walExpireToken, Token: oldSha, ExpiresAt: expiresAt})
+		} else {
+			records = append(records, walRecord{Op: walDeleteToken, Token: oldSha})
+		}
+
+		logStuff("rotating token " + id + " to token " + info.ID)
+		return info, newUUID, s.commit(records...)
+	}
+	return tokenInfo{}, "", errNoToken
+}
+
+func (s *memStore) listTokens() ([]tokenInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := make([]tokenInfo, 0, len(s.tokens))
+	for _, info := range s.tokens {
+		tokens = append(tokens, info)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].CreatedAt != tokens[j].CreatedAt {
+			return tokens[i].CreatedAt < tokens[j].CreatedAt
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+	return tokens, nil
+}
+
+func (s *memStore) getTokenGrants(id string) ([]tokenGrant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokenSha, ok := s.tokenShaLocked(id)
+	if !ok {
+		return nil, errNoToken
+	}
+	grants := make([]tokenGrant, 0, len(s.permissions[tokenSha]))
+	for perm, keyPrefixes := range s.permissions[tokenSha] {
+		for _, keyPrefix := range keyPrefixes {
+			grants = append(grants, tokenGrant{Permission: perm.permission, Context: perm.context, KeyPrefix: keyPrefix})
+		}
+	}
+	sortGrants(grants)
+	return grants, nil
+}
+
+func (s *memStore) purgeExpiredTokens() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	var records []walRecord
+	for tokenSha, info := range s.tokens {
+		if expired(info.ExpiresAt, now) {
+			records = append(records, walRecord{Op: walDeleteToken, Token: tokenSha})
+		}
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	logStuff(fmt.Sprintf("purging %d expired tokens", len(records)))
+	return len(records), s.commit(records...)
+}
+
+// tokenShaLocked returns the hash of the token with ID id; the caller must
+// hold the lock.
+func (s *memStore) tokenShaLocked(id string) (string, bool) {
+	for tokenSha, info := range s.tokens {
+		if info.ID == id {
+			return tokenSha, true
+		}
+	}
+	return "", false
+}
+
+func (s *memStore) getTokenRoles(id string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokenSha, ok := s.tokenShaLocked(id)
+	if !ok {
+		return nil, errNoToken
+	}
+	names := make([]string, 0, len(s.tokenRoles[tokenSha]))
+	for name := range s.tokenRoles[tokenSha] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memStore) createRole(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[name]; ok {
+		logStuff("error on creating role " + name)
+		return errors.New("role already exists")
+	}
+	logStuff("creating role " + name)
+	return s.commit(walRecord{Op: walCreateRole, Role: name})
+}
+
+func (s *memStore) deleteRole(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[name]; !ok {
+		logStuff("error on deleting role " + name)
+		return errNoRole
+	}
+	logStuff("deleting role " + name)
+	return s.commit(walRecord{Op: walDeleteRole, Role: name})
+}
+
+func (s *memStore) listRoles() ([]role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roles := make([]role, 0, len(s.roles))
+	for name, granted := range s.roles {
+		r := role{Name: name, Grants: make([]tokenGrant, 0, len(granted))}
+		for perm, keyPrefixes := range granted {
+			for _, keyPrefix := range keyPrefixes {
+				r.Grants = append(r.Grants, tokenGrant{Permission: perm.permission, Context: perm.context, KeyPrefix: keyPrefix})
+			}
+		}
+		sortGrants(r.Grants)
+		roles = append(roles, r)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+func (s *memStore) grantRolePermission(name string, permission string, pattern string, keyPrefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	granted, ok := s.roles[name]
+	if !ok {
+		logStuff("error on granting permission on " + pattern + " to role " + name)
+		return errNoRole
+	}
+	if slices.Contains(granted[permissionKey{permission, pattern}], keyPrefix) {
+		logStuff("error on granting permission on " + pattern + " to role " + name)
+		return errors.New("permission already granted")
+	}
+	logStuff("granting permission on " + pattern + " to role " + name)
+	return s.commit(walRecord{Op: walGrantRole, Role: name, Permission: permission, Context: pattern, KeyPrefix: keyPrefix})
+}
+
+func (s *memStore) revokeRolePermission(name string, permission string, pattern string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[name]; !ok {
+		logStuff("error on revoking permission on " + pattern + " from role " + name)
+		return errNoRole
+	}
+	logStuff("revoking permission on " + pattern + " from role " + name)
+	return s.commit(walRecord{Op: walRevokeRole, Role: name, Permission: permission, Context: pattern})
+}
+
+func (s *memStore) assignRole(id string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokenSha, ok := s.tokenShaLocked(id)
+	if !ok {
+		return errNoToken
+	}
+	if _, ok := s.roles[name]; !ok {
+		return errNoRole
+	}
+	if _, ok := s.tokenRoles[tokenSha][name]; ok {
+		logStuff("error on assigning role " + name + " to token " + id)
+		return errors.New("role already assigned")
+	}
+	logStuff("assigning role " + name + " to token " + id)
+	return s.commit(walRecord{Op: walAssignRole, Token: tokenSha, Role: name})
+}
+
+func (s *memStore) unassignRole(id string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokenSha, ok := s.tokenShaLocked(id)
+	if !ok {
+		return errNoToken
+	}
+	logStuff("unassigning role " + name + " from token " + id)
+	return s.commit(walRecord{Op: walUnassignRole, Token: tokenSha, Role: name})
+}
+
+func (s *memStore) close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal == nil {
+		return nil
+	}
+	if err := s.flushTokenUsesLocked(); err != nil {
+		s.wal.close()
+		return err
+	}
+	return s.wal.close()
+}
+
+// expiryItem schedules the removal of an entry expiring at expiresAt.
+type expiryItem struct {
+	expiresAt int64
+	context   string
+	key       string
+}
+
+// expiryHeap is a min-heap of expiryItem ordered by expiry time.
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiryItem)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sqliteStore is the Store backed by the SQLite database file. The writes of entries hold writeMu until their
+// changes are published to changes, so the events are numbered in commit order. SQLite runs a single writer at a
+// time anyway, the writes only wait for each other here instead of in the database.
+type sqliteStore struct {
+	db      *sql.DB
+	writeMu sync.Mutex
+	changes *changeHub
+}
+
+// openSQLiteStore connects to the SQLite database at path and makes sure the system tables exist. The changes to
+// entries are published to changes.
+func openSQLiteStore(path string, busyTimeout time.Duration, maxConns int, changes *changeHub) (*sqliteStore, error) {
+	db, err := connectSQLite(path, busyTimeout, maxConns)
+	if err != nil {
+		return nil, err
+	}
+
+	createContextTable(db)
+	createTokenTable(db)
+	createPermissionTable(db)
+	createRoleTables(db)
+
+	err = migrateTokenTable(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = migratePermissionTables(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = migrateContextTableNames(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = migrateContextDataTables(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: db, changes: changes}, nil
+}
+
+func (s *sqliteStore) createContext(name string) error {
+	err := validateContextName(name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = createContext(tx, name)
+	if err != nil {
+		return err
+	}
+	err = createContextDataTable(tx, name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) getContext(name string) (string, error) {
+	err := validateContextName(name)
+	if err != nil {
+		return "", err
+	}
+	return getContext(s.db, name)
+}
+
+func (s *sqliteStore) deleteContext(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteContext(tx, name)
+	if err != nil {
+		return err
+	}
+	err = deleteContextDataTable(tx, name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) createEntry(context string, key string, value string, expiresAt int64) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	_, _, _, err := createEntry(s.db, context, key, value, expiresAt)
+	if err != nil {
+		return err
+	}
+	s.changes.publish(changeEvent{Op: changeCreate, Context: context, Key: key, Value: value, Version: 1, ExpiresAt: expiresAt})
+	return nil
+}
+
+func (s *sqliteStore) getEntry(context string, key string) (entry, error) {
+	return getEntry(s.db, context, key)
+}
+
+func (s *sqliteStore) getEntries(context string, keys []string) (map[string]entry, error) {
+	return getEntries(s.db, context, keys)
+}
+
+func (s *sqliteStore) updateEntry(context string, key string, value string, expiresAt int64, expectedVersion int64) (int64, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	version, err := updateEntry(s.db, context, key, value, expiresAt, expectedVersion)
+	if err != nil {
+		return 0, err
+	}
+	s.changes.publish(changeEvent{Op: changeUpdate, Context: context, Key: key, Value: value, Version: version, ExpiresAt: expiresAt})
+	return version, nil
+}
+
+func (s *sqliteStore) deleteEntry(context string, key string, expectedVersion int64) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	err := deleteEntry(s.db, context, key, expectedVersion)
+	if err != nil {
+		return err
+	}
+	s.changes.publish(changeEvent{Op: changeDelete, Context: context, Key: key})
+	return nil
+}
+
+func (s *sqliteStore) listEntries(context string, prefix string, after string, limit int) ([]entry, error) {
+	return listEntries(s.db, context, prefix, after, limit)
+}
+
+func (s *sqliteStore) applyBatch(context string, ops []batchOp) ([]batchResult, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]batchResult, 0, len(ops))
+	for i, op := range ops {
+		current, found, err := lookupEntry(tx, context, op.Key)
+		if err == nil {
+			err = checkBatchOp(context, op, current, found)
+		}
+		if err != nil {
+			return nil, &batchError{index: i, err: err}
+		}
+
+		result := batchResult{Op: op.Op, Key: op.Key, Found: found, Entry: current}
+		switch op.Op {
+		case batchCreate:
+			_, _, _, err = createEntry(tx, context, op.Key, op.Value, op.ExpiresAt)
+			result.Entry = entry{Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt, Version: 1}
+		case batchUpdate:
+			result.Entry = entry{Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt}
+			result.Entry.Version, err = updateEntry(tx, context, op.Key, op.Value, op.ExpiresAt, op.Version)
+		case batchDelete:
+			err = deleteEntry(tx, context, op.Key, op.Version)
+		}
+		if err != nil {
+			return nil, &batchError{index: i, err: err}
+		}
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	// Watchers get every write of the batch at once.
+	s.changes.publish(batchEvents(context, results)...)
+	logStuff(fmt.Sprintf("applied batch of %d operations on context %s", len(ops), context))
+	return results, nil
+}
+
+func (s *sqliteStore) reapExpired(limit int) ([]entryRef, error) {
+	contexts, err := listContexts(s.db)
+	if err != nil {
+		return nil, err
+	}
+	var reaped []entryRef
+	for _, context := range contexts {
+		if len(reaped) >= limit {
+			break
+		}
+		refs, err := s.reapContext(context, limit-len(reaped))
+		reaped = append(reaped, refs...)
+		if err != nil {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
+
+// reapContext removes up to limit expired entries of a context and publishes their expiry.
+func (s *sqliteStore) reapContext(context string, limit int) ([]entryRef, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	keys, err := reapExpiredEntries(s.db, context, limit)
+	refs := make([]entryRef, 0, len(keys))
+	for _, key := range keys {
+		refs = append(refs, entryRef{Context: context, Key: key})
+	}
+	s.changes.publish(expiryEvents(refs)...)
+	return refs, err
+}
+
+func (s *sqliteStore) createToken(info tokenInfo) (string, error) {
+	return createToken(s.db, info)
+}
+
+func (s *sqliteStore) getToken(token string) error {
+	return getToken(s.db, token)
+}
+
+func (s *sqliteStore) deleteToken(token string) error {
+	return deleteToken(s.db, token)
+}
+
+func (s *sqliteStore) createAdmToken(secret string) (string, error) {
+	return createAdmToken(s.db, secret)
+}
+
+func (s *sqliteStore) getTokenInfo(token string) (tokenInfo, error) {
+	return getTokenInfo(s.db, token)
+}
+
+func (s *sqliteStore) rotateToken(id string, grace time.Duration) (tokenInfo, string, error) {
+	return rotateToken(s.db, id, grace)
+}
+
+func (s *sqliteStore) listTokens() ([]tokenInfo, error) {
+	return listTokens(s.db)
+}
+
+func (s *sqliteStore) getTokenGrants(id string) ([]tokenGrant, error) {
+	return getTokenGrants(s.db, id)
+}
+
+func (s *sqliteStore) getTokenRoles(id string) ([]string, error) {
+	return getTokenRoles(s.db, id)
+}
+
+func (s *sqliteStore) createRole(name string) error {
+	return createRole(s.db, name)
+}
+
+func (s *sqliteStore) deleteRole(name string) error {
+	return deleteRole(s.db, name)
+}
+
+func (s *sqliteStore) listRoles() ([]role, error) {
+	return listRoles(s.db)
+}
+
+func (s *sqliteStore) grantRolePermission(name string, permission string, pattern string, keyPrefix string) error {
+	return grantRolePermission(s.db, name, permission, pattern, keyPrefix)
+}
+
+func (s *sqliteStore) revokeRolePermission(name string, permission string, pattern string) error {
+	return revokeRolePermission(s.db, name, permission, pattern)
+}
+
+func (s *sqliteStore) assignRole(id string, name string) error {
+	return assignRole(s.db, id, name)
+}
+
+func (s *sqliteStore) unassignRole(id string, name string) error {
+	return unassignRole(s.db, id, name)
+}
+
+func (s *sqliteStore) grantTokenPermission(token string, permission string, context string, keyPrefix string) error {
+	_, _, _, err := grantTokenPermission(s.db, token, permission, context, keyPrefix)
+	return err
+}
+
+func (s *sqliteStore) rovokeTokenPermission(token string, permission string, context string) error {
+	return rovokeTokenPermission(s.db, token, permission, context)
+}
+
+func (s *sqliteStore) resetAdmToken(allAdmins bool) (string, int, int, error) {
+	return resetAdmToken(s.db, allAdmins)
+}
+
+func (s *sqliteStore) getPermission(cred credential, context string, reqType string) error {
+	return getPermission(s.db, cred, context, reqType)
+}
+
+func (s *sqliteStore) getGrants(cred credential, context string, reqType string) ([]tokenGrant, error) {
+	return getGrants(s.db, cred, context, reqType)
+}
+
+func (s *sqliteStore) purgeExpiredTokens() (int, error) {
+	return purgeExpiredTokens(s.db)
+}
+
+// close moves the content of the WAL journal into the database file before closing it, so the file alone holds
+// every committed write.
+func (s *sqliteStore) close() error {
+	_, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE);")
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
@@ -1,6 +1,7 @@
 
 import requests
 import json
+import time
 import uuid
 
 hostname = input('Type the server hostname > ').strip()
@@ -117,7 +118,7 @@ def createToken(response):
         print(
             "----> " + response.request.method + " " + response.request.path_url + " " + 
             "STATUS_CODE:" + ("OK" if response.status_code == 201 else "NOK") + " " + 
-            "BODY:" + ("OK" if response.text == '{"token":"' + f'{token}'+  '"}\n' else "NOK2")
+            "BODY:" + ("OK" if response.text == '{"created_at":"' + json.loads(response.text)['created_at'] + '","id":"' + json.loads(response.text)['id'] + '","token":"' + f'{token}' + '"}\n' else "NOK2")
             )
     return token
 
@@ -509,6 +510,681 @@ grantNonExistantToken(requests.delete(url + "/adm/token/revoke", json=data, head
 
 print()
 
+# grant GET on token on context to use the key addressed routes
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+data = {
+    "token":f"{token}",
+    "grant":"GET",
+    "context":f"{context}"
+}
+
+requests.post(url + "/adm/token/grant", json=data, headers=headers)
+
+# POST an entry addressed by the URL path
+print("POST ENTRY BY PATH")
+def postEntryByPath(response):
+    responseJSON= json.loads(response.text)
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 201 else "NOK") + " " + 
+        "BODY:" + ("OK" if responseJSON['context'] == context 
+                        and responseJSON['key'] == entry_key 
+                        and responseJSON['value'] == entry_value 
+                        and responseJSON['status'] == 'created' 
+                        else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {token}"
+}
+entry_key = str(uuid.uuid4())
+entry_value = str(uuid.uuid4())
+data = {
+    "value":entry_value
+}
+
+postEntryByPath(requests.post(url + f"/con/{context}/{entry_key}", json=data, headers=headers))
+
+print()
+
+# GET the entry addressed by the URL path, without a body
+print("GET ENTRY BY PATH")
+def getEntryByPath(response):
+    responseJSON= json.loads(response.text)
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 200 else "NOK") + " " + 
+        "BODY:" + ("OK" if responseJSON['key'] == entry_key 
+                        and responseJSON['value'] == entry_value 
+                        and responseJSON['context'] == context 
+                        else "NOK")
+        )
+
+getEntryByPath(requests.get(url + f"/con/{context}/{entry_key}", headers=headers))
+
+print()
+
+# PUT a new value on the entry addressed by the URL path
+print("UPDATE ENTRY BY PATH")
+def updateEntryByPath(response):
+    responseJSON= json.loads(response.text)
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 200 else "NOK") + " " + 
+        "BODY:" + ("OK" if responseJSON['key'] == entry_key 
+                        and responseJSON['value'] == entry_value 
+                        and responseJSON['status'] == 'updated' 
+                        else "NOK")
+        )
+
+entry_value = str(uuid.uuid4())
+data = {
+    "value":entry_value
+}
+
+updateEntryByPath(requests.put(url + f"/con/{context}/{entry_key}", json=data, headers=headers))
+
+print()
+
+# DELETE the entry addressed by the URL path and check it is gone
+print("DELETE ENTRY BY PATH")
+def deleteEntryByPath(response):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 204 else "NOK") + " " + 
+        "BODY:" + ("OK" if response.text == "" else "NOK")
+        )
+
+deleteEntryByPath(requests.delete(url + f"/con/{context}/{entry_key}", headers=headers))
+
+def getDeletedEntryByPath(response):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 404 else "NOK") + " " + 
+        "BODY:" + ("OK" if response.text == "\n" else "NOK")
+        )
+
+getDeletedEntryByPath(requests.get(url + f"/con/{context}/{entry_key}", headers=headers))
+
+print()
+
+# the body based routes keep working for existing clients: a DELETE needs PUT like before, and a query string
+# that isn't a listing parameter doesn't turn a GET into a listing
+print("DEPRECATED BODY ROUTES")
+def deprecatedRoute(response, status_code):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK") + " " + 
+        "DEPRECATION:" + ("OK" if response.headers.get("Deprecation") == "true" else "NOK")
+        )
+
+def deprecatedGet(response, key):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 200 else "NOK") + " " + 
+        "BODY:" + ("OK" if json.loads(response.text).get('key') == key else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+put_token = json.loads(requests.post(url + "/adm/token", json={}, headers=headers).text)['token']
+data = {
+    "token":f"{put_token}",
+    "grant":"PUT",
+    "context":f"{context}"
+}
+requests.post(url + "/adm/token/grant", json=data, headers=headers)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {token}"
+}
+deprecated_key = str(uuid.uuid4())
+requests.post(url + f"/con/{context}/{deprecated_key}", json={"value":"value"}, headers=headers)
+deprecatedGet(requests.get(url + f"/con/{context}?_=123", json={"key":deprecated_key}, headers=headers), deprecated_key)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {put_token}"
+}
+deprecatedRoute(requests.delete(url + f"/con/{context}", json={"key":deprecated_key}, headers=headers), 204)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+requests.delete(url + "/adm/token", json={"token":f"{put_token}"}, headers=headers)
+
+print()
+
+# a write expecting another version than the entry's is refused and changes nothing
+print("COMPARE AND SWAP")
+def compareAndSwap(response, status_code):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK")
+        )
+
+def casValue(response, value, version):
+    responseJSON= json.loads(response.text)
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 200 else "NOK") + " " + 
+        "BODY:" + ("OK" if responseJSON['value'] == value and responseJSON['version'] == version else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {token}"
+}
+cas_key = str(uuid.uuid4())
+
+requests.post(url + f"/con/{context}/{cas_key}", json={"value":"value1"}, headers=headers)
+compareAndSwap(requests.put(url + f"/con/{context}/{cas_key}", json={"value":"value2", "version":1}, headers=headers), 200)
+compareAndSwap(requests.put(url + f"/con/{context}/{cas_key}", json={"value":"value3", "version":1}, headers=headers), 409)
+compareAndSwap(requests.put(url + f"/con/{context}/{cas_key}", json={"value":"value3"}, headers={**headers, "If-Match":'"1"'}), 412)
+casValue(requests.get(url + f"/con/{context}/{cas_key}", headers=headers), "value2", 2)
+compareAndSwap(requests.delete(url + f"/con/{context}/{cas_key}", headers={**headers, "If-Match":'"1"'}), 412)
+compareAndSwap(requests.delete(url + f"/con/{context}/{cas_key}", headers={**headers, "If-Match":'"2"'}), 204)
+
+print()
+
+# a batch failing on one of its operations writes none of them
+print("BATCH ATOMICITY")
+def batchAtomicity(response, status_code):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK") + " " + 
+        "BODY:" + ("OK" if response.text.startswith("operation 1:") else "NOK")
+        )
+
+batch_key = str(uuid.uuid4())
+new_key = str(uuid.uuid4())
+requests.post(url + f"/con/{context}/{batch_key}", json={"value":"value1"}, headers=headers)
+
+data = {
+    "operations":[
+        {"op":"create", "key":new_key, "value":"value"},
+        {"op":"update", "key":batch_key, "value":"value2", "version":5}
+    ]
+}
+batchAtomicity(requests.post(url + f"/con/{context}/_batch", json=data, headers=headers), 409)
+data = {
+    "operations":[
+        {"op":"create", "key":new_key, "value":"value"},
+        {"op":"create", "key":batch_key, "value":"value2"}
+    ]
+}
+batchAtomicity(requests.post(url + f"/con/{context}/_batch", json=data, headers=headers), 400)
+
+compareAndSwap(requests.get(url + f"/con/{context}/{new_key}", headers=headers), 404)
+casValue(requests.get(url + f"/con/{context}/{batch_key}", headers=headers), "value1", 1)
+requests.delete(url + f"/con/{context}/{batch_key}", headers=headers)
+
+print()
+
+# grants limited to key prefixes only add keys, whatever the other grants covering the context
+print("KEY PREFIX GRANTS")
+def keyPrefixGrant(response, status_code):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+prefix_token = json.loads(requests.post(url + "/adm/token", json={}, headers=headers).text)['token']
+for grant, grant_context, key_prefix in [("GET", context, "svc:"), ("GET", "*", ""), ("PUT", context, "a:"), ("PUT", context, "b:")]:
+    data = {
+        "token":f"{prefix_token}",
+        "grant":grant,
+        "context":grant_context,
+        "key_prefix":key_prefix
+    }
+    requests.post(url + "/adm/token/grant", json=data, headers=headers)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {token}"
+}
+for key in ["other", "a:x", "b:x", "c:x"]:
+    requests.post(url + f"/con/{context}/{key}", json={"value":"value"}, headers=headers)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {prefix_token}"
+}
+keyPrefixGrant(requests.get(url + f"/con/{context}/other", headers=headers), 200)
+keyPrefixGrant(requests.put(url + f"/con/{context}/a:x", json={"value":"value"}, headers=headers), 200)
+keyPrefixGrant(requests.put(url + f"/con/{context}/b:x", json={"value":"value"}, headers=headers), 200)
+keyPrefixGrant(requests.put(url + f"/con/{context}/c:x", json={"value":"value"}, headers=headers), 403)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {token}"
+}
+for key in ["other", "a:x", "b:x", "c:x"]:
+    requests.delete(url + f"/con/{context}/{key}", headers=headers)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+requests.delete(url + "/adm/token", json={"token":f"{prefix_token}"}, headers=headers)
+
+print()
+
+# grants on a pattern cover the contexts matching it, even when created later, next to the grants on exact names
+print("CONTEXT PATTERN GRANTS")
+def patternGrant(response, status_code):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+pattern = f'glob{random.randint(1,100)}_'
+other_context = f'other{random.randint(1,100)}'
+for pattern_context in [pattern + "one", pattern + "two", other_context]:
+    requests.post(url + "/adm/context", json={"context":pattern_context}, headers=headers)
+
+pattern_token = json.loads(requests.post(url + "/adm/token", json={}, headers=headers).text)['token']
+for grant, grant_context in [("GET", pattern + "*"), ("PUT", pattern + "*"), ("POST", pattern + "one")]:
+    data = {
+        "token":f"{pattern_token}",
+        "grant":grant,
+        "context":grant_context
+    }
+    requests.post(url + "/adm/token/grant", json=data, headers=headers)
+requests.post(url + "/adm/context", json={"context":pattern + "three"}, headers=headers)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {pattern_token}"
+}
+patternGrant(requests.post(url + f"/con/{pattern}one/key", json={"value":"value"}, headers=headers), 201)
+patternGrant(requests.put(url + f"/con/{pattern}one/key", json={"value":"value2"}, headers=headers), 200)
+patternGrant(requests.get(url + f"/con/{pattern}one/key", headers=headers), 200)
+patternGrant(requests.post(url + f"/con/{pattern}two/key", json={"value":"value"}, headers=headers), 401)
+patternGrant(requests.get(url + f"/con/{pattern}three/key", headers=headers), 404)
+patternGrant(requests.get(url + f"/con/{other_context}/key", headers=headers), 401)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+for pattern_context in [pattern + "one", pattern + "two", pattern + "three", other_context]:
+    requests.delete(url + "/adm/context", json={"context":pattern_context}, headers=headers)
+requests.delete(url + "/adm/token", json={"token":f"{pattern_token}"}, headers=headers)
+
+print()
+
+# a watch stream ends with an error event once the grant of its token is revoked
+print("WATCH REVOKED TOKEN")
+def watchRevoked(response, lines):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 200 else "NOK") + " " + 
+        "STREAM:" + ("OK" if "event: create" in lines and lines[-2:] == ["event: error", 'data: {"error":"not authorized"}'] else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+watch_token = json.loads(requests.post(url + "/adm/token", json={}, headers=headers).text)['token']
+data = {
+    "token":f"{watch_token}",
+    "grant":"GET",
+    "context":f"{context}"
+}
+requests.post(url + "/adm/token/grant", json=data, headers=headers)
+
+response = requests.get(url + f"/con/{context}/_watch", headers={"Authorization": f"bearer {watch_token}"}, stream=True, timeout=10)
+requests.post(url + f"/con/{context}/watched", json={"value":"value"}, headers={"Authorization": f"bearer {token}"})
+requests.delete(url + "/adm/token/revoke", json=data, headers=headers)
+requests.delete(url + f"/con/{context}/watched", headers={"Authorization": f"bearer {token}"})
+watchRevoked(response, [line for line in response.iter_lines(decode_unicode=True) if line.startswith("event:") or line.startswith("data: {\"error")])
+response.close()
+requests.delete(url + "/adm/token", json={"token":f"{watch_token}"}, headers=headers)
+
+print()
+
+# a delegated admin token only administers the contexts of its grants, never hands down more than it holds,
+# and only rotates or deletes the tokens it could have granted
+print("DELEGATED ADMIN TOKENS")
+def delegatedAdmin(response, status_code):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+team = f'teamone{random.randint(1,100)}_'
+other_team = f'teamtwo{random.randint(1,100)}_'
+requests.post(url + "/adm/context", json={"context":other_team + "billing"}, headers=headers)
+lead_token = json.loads(requests.post(url + "/adm/token", json={}, headers=headers).text)['token']
+for grant, grant_context in [("ADM_CONTEXT_POST", team + "*"), ("ADM_TOKEN_GRANT", team + "*"), ("ADM_TOKEN_POST", "ALL"), ("ADM_TOKEN_ROTATE", "ALL"), ("ADM_TOKEN_DELETE", "ALL")]:
+    data = {
+        "token":f"{lead_token}",
+        "grant":grant,
+        "context":grant_context
+    }
+    requests.post(url + "/adm/token/grant", json=data, headers=headers)
+outside_token = json.loads(requests.post(url + "/adm/token", json={}, headers=headers).text)['token']
+data = {
+    "token":f"{outside_token}",
+    "grant":"GET",
+    "context":f"{context}"
+}
+requests.post(url + "/adm/token/grant", json=data, headers=headers)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {lead_token}"
+}
+delegatedAdmin(requests.post(url + "/adm/context", json={"context":team + "billing"}, headers=headers), 201)
+delegatedAdmin(requests.post(url + "/adm/context", json={"context":other_team + "sales"}, headers=headers), 401)
+member_token = json.loads(requests.post(url + "/adm/token", json={}, headers=headers).text)['token']
+delegatedAdmin(requests.post(url + "/adm/token/grant", json={"token":member_token, "grant":"GET", "context":team + "billing"}, headers=headers), 201)
+delegatedAdmin(requests.post(url + "/adm/token/grant", json={"token":member_token, "grant":"GET", "context":other_team + "billing"}, headers=headers), 401)
+delegatedAdmin(requests.post(url + "/adm/token/grant", json={"token":member_token, "grant":"ADM_CONTEXT_DELETE", "context":team + "*"}, headers=headers), 403)
+delegatedAdmin(requests.post(url + "/adm/token/rotate", json={"token":ADM_TOKEN}, headers=headers), 403)
+delegatedAdmin(requests.delete(url + "/adm/token", json={"token":ADM_TOKEN}, headers=headers), 403)
+delegatedAdmin(requests.delete(url + "/adm/token", json={"token":outside_token}, headers=headers), 403)
+delegatedAdmin(requests.delete(url + "/adm/token", json={"token":member_token}, headers=headers), 200)
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+for team_context in [team + "billing", other_team + "billing"]:
+    requests.delete(url + "/adm/context", json={"context":team_context}, headers=headers)
+for team_token in [lead_token, outside_token]:
+    requests.delete(url + "/adm/token", json={"token":team_token}, headers=headers)
+
+print()
+
+# tokens carry a name, labels and an expiry, are listed with their metadata and grants, and are refused once expired
+print("TOKEN METADATA")
+def tokenMetadata(response, status_code, check):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK") + " " + 
+        "BODY:" + ("OK" if check(response.text) else "NOK")
+        )
+
+from datetime import datetime
+
+def expiresIn(body, seconds):
+    created = json.loads(body)
+    created_at = datetime.fromisoformat(created['created_at'].replace("Z", "+00:00"))
+    expires_at = datetime.fromisoformat(created['expires_at'].replace("Z", "+00:00"))
+    return (expires_at - created_at).total_seconds() == seconds
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+data = {
+    "name":"billing-service",
+    "labels":{"team":"billing"},
+    "ttl":3600
+}
+response = requests.post(url + "/adm/token", json=data, headers=headers)
+named = json.loads(response.text)
+tokenMetadata(response, 201, lambda body: expiresIn(body, 3600) and body == 
+    '{"created_at":"' + named['created_at'] + '","expires_at":"' + named['expires_at'] + '","id":"' + named['id'] + 
+    '","labels":{"team":"billing"},"name":"billing-service","token":"' + named['token'] + '"}\n')
+tokenMetadata(requests.post(url + "/adm/token", json={"ttl":60, "expires_at":"2030-01-01T00:00:00Z"}, headers=headers), 400, lambda body: True)
+data = {
+    "token":named['token'],
+    "grant":"GET",
+    "context":f"{context}",
+    "key_prefix":"billing:"
+}
+requests.post(url + "/adm/token/grant", json=data, headers=headers)
+
+tokenMetadata(requests.get(url + "/adm/token", headers=headers), 200, lambda body: any(
+    listed['id'] == named['id'] and listed['name'] == "billing-service" and listed['labels'] == {"team":"billing"} 
+    and listed['expires_at'] == named['expires_at'] and 'token' not in listed
+    for listed in json.loads(body)['tokens']))
+tokenMetadata(requests.get(url + f"/adm/token/{named['id']}/grants", headers=headers), 200, lambda body: 
+    json.loads(body) == {"id":named['id'], "grants":[{"permission":"GET", "context":context, "key_prefix":"billing:"}], "roles":[]})
+tokenMetadata(requests.get(url + f"/adm/token/{uuid.uuid4()}/grants", headers=headers), 404, lambda body: True)
+
+expiring = json.loads(requests.post(url + "/adm/token", json={"ttl":1}, headers=headers).text)
+data = {
+    "token":expiring['token'],
+    "grant":"GET",
+    "context":f"{context}"
+}
+requests.post(url + "/adm/token/grant", json=data, headers=headers)
+time.sleep(1.5)
+tokenMetadata(requests.get(url + f"/con/{context}/expiring", headers={"Authorization": f"bearer {expiring['token']}"}), 401, 
+    lambda body: body == "token expired\n")
+
+for created in [named, expiring]:
+    requests.delete(url + "/adm/token", json={"token":created['token']}, headers=headers)
+
+print()
+
+# a role grants its permissions to the tokens holding it: edits apply right away, unassigning it removes them,
+# and a rotated token keeps its roles
+print("ROLES")
+def roleAccess(response, status_code):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+role = f'reader{random.randint(1,100)}'
+role_key = str(uuid.uuid4())
+requests.post(url + f"/con/{context}/{role_key}", json={"value":"value"}, headers={"Authorization": f"bearer {token}"})
+roleAccess(requests.post(url + "/adm/role", json={"role":role}, headers=headers), 201)
+role_token = json.loads(requests.post(url + "/adm/token", json={}, headers=headers).text)
+roleAccess(requests.post(url + "/adm/token/role", json={"id":role_token['id'], "role":role}, headers=headers), 201)
+
+role_headers = {"Authorization": f"bearer {role_token['token']}"}
+roleAccess(requests.get(url + f"/con/{context}/{role_key}", headers=role_headers), 401)
+roleAccess(requests.post(url + "/adm/role/grant", json={"role":role, "grant":"GET", "context":f"{context}"}, headers=headers), 201)
+roleAccess(requests.get(url + f"/con/{context}/{role_key}", headers=role_headers), 200)
+
+rotated = json.loads(requests.post(url + "/adm/token/rotate", json={"id":role_token['id']}, headers=headers).text)
+role_headers = {"Authorization": f"bearer {rotated['token']}"}
+roleAccess(requests.get(url + f"/con/{context}/{role_key}", headers=role_headers), 200)
+
+roleAccess(requests.delete(url + "/adm/role/revoke", json={"role":role, "grant":"GET", "context":f"{context}"}, headers=headers), 200)
+roleAccess(requests.get(url + f"/con/{context}/{role_key}", headers=role_headers), 401)
+requests.post(url + "/adm/role/grant", json={"role":role, "grant":"GET", "context":f"{context}"}, headers=headers)
+roleAccess(requests.delete(url + "/adm/token/role", json={"id":rotated['id'], "role":role}, headers=headers), 200)
+roleAccess(requests.get(url + f"/con/{context}/{role_key}", headers=role_headers), 401)
+
+requests.delete(url + "/adm/token", json={"token":rotated['token']}, headers=headers)
+requests.delete(url + "/adm/role", json={"role":role}, headers=headers)
+requests.delete(url + f"/con/{context}/{role_key}", headers={"Authorization": f"bearer {token}"})
+
+print()
+
+# context names follow a grammar and are unique whatever their case
+print("CONTEXT NAMES")
+def contextName(response, status_code):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+for invalid in ["short", "1startsdigit", "has-a-dash", "x" * 65, 'ctx"; DROP TABLE token; --']:
+    contextName(requests.post(url + "/adm/context", json={"context":invalid}, headers=headers), 400)
+contextName(requests.post(url + "/adm/context", json={"context":context.upper()}, headers=headers), 400)
+
+print()
+
+# a listing returns the keys starting with a prefix in lexical order, a page at a time
+print("LIST ENTRIES")
+def listEntries(response, keys, values, more):
+    responseJSON = json.loads(response.text)
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 200 else "NOK") + " " + 
+        "BODY:" + ("OK" if [entry['key'] for entry in responseJSON['entries']] == keys 
+                        and all(('value' in entry) == values for entry in responseJSON['entries']) 
+                        and ('next_cursor' in responseJSON) == more 
+                        else "NOK")
+        )
+    return responseJSON.get('next_cursor', "")
+
+def listInvalid(response):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == 400 else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {token}"
+}
+list_prefix = f'list{random.randint(1,100)}:'
+for key in ["c", "a", "b/x", "d"]:
+    requests.post(url + f"/con/{context}/{list_prefix}{key}", json={"value":key}, headers=headers)
+requests.post(url + f"/con/{context}/other:a", json={"value":"other"}, headers=headers)
+
+cursor = listEntries(requests.get(url + f"/con/{context}?prefix={list_prefix}&limit=3", headers=headers), 
+    [list_prefix + "a", list_prefix + "b/x", list_prefix + "c"], False, True)
+listEntries(requests.get(url + f"/con/{context}?prefix={list_prefix}&limit=3&cursor={cursor}&values=true", headers=headers), 
+    [list_prefix + "d"], True, False)
+listEntries(requests.get(url + f"/con/{context}?prefix={list_prefix}z", headers=headers), [], False, False)
+listInvalid(requests.get(url + f"/con/{context}?limit=1001", headers=headers))
+listInvalid(requests.get(url + f"/con/{context}?cursor=!!", headers=headers))
+
+for key in ["c", "a", "b/x", "d"]:
+    requests.delete(url + f"/con/{context}/{list_prefix}{key}", headers=headers)
+requests.delete(url + f"/con/{context}/other:a", headers=headers)
+
+print()
+
+# an entry written with a ttl is invisible once it expires, and a PUT without one makes it permanent again
+print("ENTRY EXPIRY")
+def entryExpiry(response, status_code, expiring):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK") + " " + 
+        "BODY:" + ("OK" if status_code >= 400 or (('expires_at' in json.loads(response.text) and 'ttl' in json.loads(response.text)) == expiring) else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {token}"
+}
+expiring_key = str(uuid.uuid4())
+permanent_key = str(uuid.uuid4())
+entryExpiry(requests.post(url + f"/con/{context}/{expiring_key}", json={"value":"value", "ttl":1}, headers=headers), 201, True)
+entryExpiry(requests.get(url + f"/con/{context}/{expiring_key}", headers=headers), 200, True)
+entryExpiry(requests.post(url + f"/con/{context}/{permanent_key}", json={"value":"value", "ttl":1}, headers=headers), 201, True)
+entryExpiry(requests.put(url + f"/con/{context}/{permanent_key}", json={"value":"value"}, headers=headers), 200, False)
+entryExpiry(requests.post(url + f"/con/{context}/{uuid.uuid4()}", json={"value":"value", "ttl":1, "expires_at":"2030-01-01T00:00:00Z"}, headers=headers), 400, False)
+time.sleep(1.5)
+entryExpiry(requests.get(url + f"/con/{context}/{expiring_key}", headers=headers), 404, False)
+entryExpiry(requests.get(url + f"/con/{context}/{permanent_key}", headers=headers), 200, False)
+requests.delete(url + f"/con/{context}/{permanent_key}", headers=headers)
+
+print()
+
+# a multi-get returns the entries in the order of the keys asked for, and lists the missing ones
+print("MULTI GET")
+def multiGet(response, status_code, expected):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK") + " " + 
+        "BODY:" + ("OK" if expected is None or json.loads(response.text) == expected else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {token}"
+}
+mget_keys = [str(uuid.uuid4()), str(uuid.uuid4()), str(uuid.uuid4())]
+for key in mget_keys[:2]:
+    requests.post(url + f"/con/{context}/{key}", json={"value":key}, headers=headers)
+
+multiGet(requests.post(url + f"/con/{context}/_mget", json={"keys":[mget_keys[1], mget_keys[2], mget_keys[0]]}, headers=headers), 200, {
+    "context":context,
+    "entries":[
+        {"key":mget_keys[1], "found":True, "value":mget_keys[1], "version":1},
+        {"key":mget_keys[2], "found":False},
+        {"key":mget_keys[0], "found":True, "value":mget_keys[0], "version":1}
+    ],
+    "missing":[mget_keys[2]]
+})
+multiGet(requests.post(url + f"/con/{context}/_mget", json={"keys":[]}, headers=headers), 400, None)
+multiGet(requests.post(url + f"/con/{context}/_mget", json={"keys":[mget_keys[0]]}, headers={"Authorization": f"bearer {ADM_TOKEN}"}), 401, None)
+for key in mget_keys[:2]:
+    requests.delete(url + f"/con/{context}/{key}", headers=headers)
+
+print()
+
+print("TOKEN ROTATION")
+def tokenRotation(response, status_code, check):
+    print(
+        "----> " + response.request.method + " " + response.request.path_url + " " + 
+        "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK") + " " + 
+        "BODY:" + ("OK" if check(response.text) else "NOK")
+        )
+
+headers = {
+    "Content-Type": "application/json",
+    "Authorization": f"bearer {ADM_TOKEN}"
+}
+rotation_key = str(uuid.uuid4())
+requests.post(url + f"/con/{context}/{rotation_key}", json={"value":"rotated"}, headers={"Authorization": f"bearer {token}"})
+original = json.loads(requests.post(url + "/adm/token", json={"name":"rotated-service"}, headers=headers).text)
+requests.post(url + "/adm/token/grant", json={"token":original['token'], "grant":"GET", "context":context}, headers=headers)
+
+response = requests.post(url + "/adm/token/rotate", json={"token":original['token']}, headers=headers)
+rotated = json.loads(response.text)
+tokenRotation(response, 201, lambda body: rotated['rotated_id'] == original['id'] and rotated['id'] != original['id'] 
+    and rotated['name'] == "rotated-service" and rotated['token'] != original['token'])
+tokenRotation(requests.get(url + f"/con/{context}/{rotation_key}", headers={"Authorization": f"bearer {original['token']}"}), 401, lambda body: True)
+tokenRotation(requests.get(url + f"/con/{context}/{rotation_key}", headers={"Authorization": f"bearer {rotated['token']}"}), 200, lambda body: 
+    json.loads(body)['value'] == "rotated")
+tokenRotation(requests.get(url + f"/adm/token/{rotated['id']}/grants", headers=headers), 200, lambda body: 
+    json.loads(body) == {"id":rotated['id'], "grants":[{"permission":"GET", "context":context}], "roles":[]})
+
+response = requests.post(url + "/adm/token/rotate", json={"id":rotated['id'], "grace_minutes":30}, headers=headers)
+graced = json.loads(response.text)
+tokenRotation(response, 201, lambda body: graced['rotated_id'] == rotated['id'])
+tokenRotation(requests.get(url + f"/con/{context}/{rotation_key}", headers={"Authorization": f"bearer {rotated['token']}"}), 200, lambda body: True)
+tokenRotation(requests.get(url + f"/con/{context}/{rotation_key}", headers={"Authorization": f"bearer {graced['token']}"}), 200, lambda body: True)
+tokenRotation(requests.post(url + "/adm/token/rotate", json={"id":graced['id'], "grace_minutes":-1}, headers=headers), 400, lambda body: True)
+
+requests.delete(url + f"/con/{context}/{rotation_key}", headers={"Authorization": f"bearer {token}"})
+for rotation_token in [rotated['token'], graced['token']]:
+    requests.delete(url + "/adm/token", json={"token":rotation_token}, headers=headers)
+
+print()
+
 # delete context
 print("DELETE CONTEXT")
 def deleteContext(response):
@@ -573,3 +1249,559 @@ deleteContext(requests.delete(url + "/adm/token", json=data, headers=headers))
 print()
 
 # check if the token was deleted - functionality does not exists yet
+
+# the restart tests start servers of their own with the memory store, when WALKYRIA_BIN names the server binary
+import os
+import subprocess
+import tempfile
+
+walkyria_bin = os.environ.get("WALKYRIA_BIN", "")
+restart_url = "http://localhost:53998"
+
+def startServer(directory, *flags, env=None):
+    process = subprocess.Popen(
+        [walkyria_bin, "-port", "53998", "-store", "memory", "-db", os.path.join(directory, "db.sqlite3"),
+         "-audit-file", "", *flags],
+        cwd=directory, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL, env={**os.environ, **(env or {})})
+    for _ in range(50):
+        try:
+            requests.get(restart_url + "/adm/context")
+            break
+        except Exception:
+            time.sleep(0.1)
+    # a provided admin token is never written to the file
+    if not os.path.exists(os.path.join(directory, "admin-token")):
+        return process, ""
+    with open(os.path.join(directory, "admin-token")) as file:
+        return process, file.read().strip()
+
+def stopServer(process):
+    process.terminate()
+    process.wait()
+
+def restartSetup(adm_token):
+    headers = {
+        "Content-Type": "application/json",
+        "Authorization": f"bearer {adm_token}"
+    }
+    requests.post(restart_url + "/adm/context", json={"context":"restartctx"}, headers=headers)
+    restart_token = json.loads(requests.post(restart_url + "/adm/token", json={}, headers=headers).text)['token']
+    for grant in ["POST", "PUT", "GET", "DELETE"]:
+        data = {
+            "token":f"{restart_token}",
+            "grant":grant,
+            "context":"restartctx"
+        }
+        requests.post(restart_url + "/adm/token/grant", json=data, headers=headers)
+    return {
+        "Content-Type": "application/json",
+        "Authorization": f"bearer {restart_token}"
+    }
+
+def restartEntries(test, headers, entries):
+    found = True
+    for key, value in entries.items():
+        response = requests.get(restart_url + f"/con/restartctx/{key}", headers=headers)
+        found = found and response.status_code == 200 and json.loads(response.text)['value'] == value
+    print(
+        "----> " + test + " " + 
+        "ENTRIES:" + ("OK" if found else "NOK")
+        )
+
+if walkyria_bin:
+    # a record torn by a crash at the end of the log is dropped, the entries before it are kept
+    print("WAL TORN TAIL REPLAY")
+    with tempfile.TemporaryDirectory() as directory:
+        process, adm_token = startServer(directory)
+        headers = restartSetup(adm_token)
+        requests.post(restart_url + "/con/restartctx/torn1", json={"value":"value1"}, headers=headers)
+        stopServer(process)
+
+        segments = sorted(name for name in os.listdir(directory) if name.startswith("db.wal."))
+        with open(os.path.join(directory, segments[-1]), "ab") as file:
+            file.write(b"\x40\x00\x00\x00torn")
+
+        process, adm_token = startServer(directory)
+        restartEntries("RESTART AFTER TORN TAIL", headers, {"torn1":"value1"})
+        requests.post(restart_url + "/con/restartctx/torn2", json={"value":"value2"}, headers=headers)
+        stopServer(process)
+
+        process, adm_token = startServer(directory)
+        restartEntries("RESTART AFTER APPENDING TO THE TRUNCATED LOG", headers, {"torn1":"value1", "torn2":"value2"})
+        stopServer(process)
+
+    print()
+
+if walkyria_bin:
+    # a restart loads the latest snapshot and replays the log written after it, the segments it covers are deleted
+    print("SNAPSHOT AND COMPACTION RESTART")
+    def compactedSegments(directory, segments):
+        print(
+            "----> SNAPSHOT " + 
+            "FILE:" + ("OK" if os.path.exists(os.path.join(directory, "db.snapshot")) else "NOK") + " " + 
+            "SEGMENTS:" + ("OK" if segments[0] not in os.listdir(directory) else "NOK")
+            )
+
+    with tempfile.TemporaryDirectory() as directory:
+        process, adm_token = startServer(directory, "-snapshot-interval", "1s")
+        headers = restartSetup(adm_token)
+        for key in ["snap1", "snap2"]:
+            requests.post(restart_url + f"/con/restartctx/{key}", json={"value":key}, headers=headers)
+        segments = sorted(name for name in os.listdir(directory) if name.startswith("db.wal."))
+        time.sleep(2.5)
+
+        requests.post(restart_url + "/con/restartctx/snap3", json={"value":"snap3"}, headers=headers)
+        requests.put(restart_url + "/con/restartctx/snap1", json={"value":"updated"}, headers=headers)
+        requests.delete(restart_url + "/con/restartctx/snap2", headers=headers)
+        stopServer(process)
+        compactedSegments(directory, segments)
+
+        process, adm_token = startServer(directory)
+        restartEntries("RESTART FROM THE SNAPSHOT", headers, {"snap1":"updated", "snap3":"snap3"})
+        response = requests.get(restart_url + "/con/restartctx/snap2", headers=headers)
+        print(
+            "----> " + response.request.method + " " + response.request.path_url + " " + 
+            "STATUS_CODE:" + ("OK" if response.status_code == 404 else "NOK")
+            )
+        stopServer(process)
+
+    print()
+
+if walkyria_bin:
+    # the audit records of administrative actions name the token, permission and key prefix they act on, and batches their keys
+    print("AUDIT RECORDS")
+    def auditRecord(test, headers, action, expected):
+        response = requests.get(restart_url + f"/adm/audit?action={action}&limit=1", headers=headers)
+        records = json.loads(response.text)['records']
+        print(
+            "----> " + test + " " + 
+            "STATUS_CODE:" + ("OK" if response.status_code == 200 else "NOK") + " " + 
+            "RECORD:" + ("OK" if len(records) == 1 and all(records[0].get(field) == value for field, value in expected.items()) else "NOK")
+            )
+
+    with tempfile.TemporaryDirectory() as directory:
+        process, adm_token = startServer(directory, "-audit-file", os.path.join(directory, "audit.log"))
+        adm_headers = {
+            "Content-Type": "application/json",
+            "Authorization": f"bearer {adm_token}"
+        }
+        requests.post(restart_url + "/adm/context", json={"context":"restartctx"}, headers=adm_headers)
+        created = json.loads(requests.post(restart_url + "/adm/token", json={}, headers=adm_headers).text)
+        data = {
+            "token":created['token'],
+            "grant":"POST",
+            "context":"restartctx",
+            "key_prefix":"svc:"
+        }
+        requests.post(restart_url + "/adm/token/grant", json=data, headers=adm_headers)
+        headers = {
+            "Content-Type": "application/json",
+            "Authorization": f"bearer {created['token']}"
+        }
+        data = {
+            "operations":[
+                {"op":"create", "key":"svc:one", "value":"value"},
+                {"op":"create", "key":"svc:two", "value":"value"}
+            ]
+        }
+        requests.post(restart_url + "/con/restartctx/_batch", json=data, headers=headers)
+        requests.delete(restart_url + "/adm/token", json={"token":created['token']}, headers=adm_headers)
+
+        auditRecord("TOKEN CREATE", adm_headers, "token.create", {"target_token_id":created['id']})
+        auditRecord("TOKEN GRANT", adm_headers, "token.grant", {"target_token_id":created['id'], "permission":"POST", "context":"restartctx", "key_prefix":"svc:"})
+        auditRecord("ENTRY BATCH", adm_headers, "entry.batch", {"token_id":created['id'], "keys":["svc:one", "svc:two"]})
+        auditRecord("TOKEN DELETE", adm_headers, "token.delete", {"target_token_id":created['id']})
+        stopServer(process)
+
+    print()
+
+if walkyria_bin:
+    # expired tokens are purged with their permissions every -token-purge-interval
+    print("EXPIRED TOKEN PURGE")
+    with tempfile.TemporaryDirectory() as directory:
+        process, adm_token = startServer(directory, "-token-purge-interval", "1s")
+        headers = {
+            "Content-Type": "application/json",
+            "Authorization": f"bearer {adm_token}"
+        }
+        requests.post(restart_url + "/adm/context", json={"context":"restartctx"}, headers=headers)
+        expiring = json.loads(requests.post(restart_url + "/adm/token", json={"ttl":1}, headers=headers).text)
+        requests.post(restart_url + "/adm/token/grant", json={"token":expiring['token'], "grant":"GET", "context":"restartctx"}, headers=headers)
+        time.sleep(2.5)
+
+        response = requests.get(restart_url + f"/adm/token/{expiring['id']}/grants", headers=headers)
+        listed = [listed['id'] for listed in json.loads(requests.get(restart_url + "/adm/token", headers=headers).text)['tokens']]
+        print(
+            "----> " + response.request.method + " " + response.request.path_url + " " + 
+            "STATUS_CODE:" + ("OK" if response.status_code == 404 else "NOK") + " " + 
+            "LISTED:" + ("OK" if expiring['id'] not in listed else "NOK")
+            )
+        stopServer(process)
+
+    print()
+
+if walkyria_bin:
+    # the context tables of a database written before context names were validated are renamed once at startup,
+    # unless two contexts differ by case only and shared a table
+    print("CONTEXT TABLE MIGRATION")
+    import hashlib
+    import sqlite3
+
+    def legacyDatabase(directory, contexts):
+        db = sqlite3.connect(os.path.join(directory, "db.sqlite3"))
+        db.execute("CREATE TABLE context (name TEXT UNIQUE)")
+        db.execute("CREATE TABLE token (token TEXT UNIQUE)")
+        db.execute("CREATE TABLE permission (token TEXT, permission TEXT, context TEXT, UNIQUE (token, permission, context))")
+        db.execute("CREATE TABLE legacyctx01 (key TEXT UNIQUE, value TEXT)")
+        db.execute("INSERT INTO legacyctx01 (key, value) VALUES ('legacykey', 'legacyvalue')")
+        for legacy_context in contexts:
+            db.execute("INSERT INTO context (name) VALUES (?)", (legacy_context,))
+        legacy_token = str(uuid.uuid4())
+        db.execute("INSERT INTO token (token) VALUES (?)", (hashlib.sha256(legacy_token.encode()).hexdigest(),))
+        db.execute("INSERT INTO permission (token, permission, context) VALUES (?, 'GET', 'legacyctx01')", 
+            (hashlib.sha256(legacy_token.encode()).hexdigest(),))
+        db.commit()
+        db.close()
+        return legacy_token
+
+    with tempfile.TemporaryDirectory() as directory:
+        legacy_token = legacyDatabase(directory, ["legacyctx01"])
+        process, adm_token = startServer(directory, "-store", "sqlite")
+        response = requests.get(restart_url + "/con/legacyctx01/legacykey", headers={"Authorization": f"bearer {legacy_token}"})
+        stopServer(process)
+        db = sqlite3.connect(os.path.join(directory, "db.sqlite3"))
+        tables = [name for (name,) in db.execute("SELECT name FROM sqlite_master WHERE type = 'table'")]
+        db.close()
+        print(
+            "----> " + response.request.method + " " + response.request.path_url + " " + 
+            "STATUS_CODE:" + ("OK" if response.status_code == 200 and json.loads(response.text)['value'] == "legacyvalue" else "NOK") + " " + 
+            "TABLES:" + ("OK" if "legacyctx01" not in tables and any(name.startswith("ctx_legacyctx01_") for name in tables) else "NOK")
+            )
+
+    with tempfile.TemporaryDirectory() as directory:
+        legacyDatabase(directory, ["legacyctx01", "LegacyCtx01"])
+        result = subprocess.run([walkyria_bin, "-port", "53998", "-store", "sqlite", "-db", os.path.join(directory, "db.sqlite3"), 
+            "-audit-file", ""], cwd=directory, capture_output=True, text=True, timeout=10)
+        print(
+            "----> CASE COLLISION " + 
+            "REFUSED:" + ("OK" if result.returncode != 0 and "differ by case only" in result.stdout + result.stderr else "NOK")
+            )
+
+    print()
+
+import shutil
+
+if walkyria_bin and shutil.which("openssl"):
+    # a verified client certificate acts as the token it is mapped to, the map is reloaded when it changes,
+    # and rotating a mapped token tells which certificates still name its old ID
+    print("MUTUAL TLS")
+    def openssl(directory, *args):
+        subprocess.run(["openssl", *args], cwd=directory, check=True, capture_output=True)
+
+    def signedCertificate(directory, name, subject):
+        openssl(directory, "req", "-newkey", "rsa:2048", "-nodes", "-keyout", name + ".key", "-out", name + ".csr", "-subj", subject)
+        openssl(directory, "x509", "-req", "-in", name + ".csr", "-CA", "ca.pem", "-CAkey", "ca.key", "-CAcreateserial", 
+            "-out", name + ".pem", "-days", "1", "-extfile", "san.ext")
+        return (os.path.join(directory, name + ".pem"), os.path.join(directory, name + ".key"))
+
+    def clientMap(directory, subjects):
+        with open(os.path.join(directory, "client-map.json"), "w") as file:
+            json.dump(subjects, file)
+
+    def mutualTLS(test, response, status_code):
+        print(
+            "----> " + test + " " + response.request.method + " " + response.request.path_url + " " + 
+            "STATUS_CODE:" + ("OK" if response.status_code == status_code else "NOK")
+            )
+
+    with tempfile.TemporaryDirectory() as directory:
+        with open(os.path.join(directory, "san.ext"), "w") as file:
+            file.write("subjectAltName=DNS:localhost\n")
+        openssl(directory, "req", "-x509", "-newkey", "rsa:2048", "-nodes", "-keyout", "ca.key", "-out", "ca.pem", "-days", "1", 
+            "-subj", "/CN=walkyria test ca")
+        ca = os.path.join(directory, "ca.pem")
+        server_cert = signedCertificate(directory, "server", "/CN=localhost")
+        mapped_cert = signedCertificate(directory, "mapped", "/CN=mapped")
+        unmapped_cert = signedCertificate(directory, "unmapped", "/CN=unmapped")
+        clientMap(directory, {})
+
+        process, adm_token = startServer(directory, "-tls-cert", server_cert[0], "-tls-key", server_cert[1], "-tls-client-ca", ca, 
+            "-tls-client-map", os.path.join(directory, "client-map.json"), "-tls-reload-interval", "1s")
+        tls_url = "https://localhost:53998"
+        headers = {
+            "Content-Type": "application/json",
+            "Authorization": f"bearer {adm_token}"
+        }
+        requests.post(tls_url + "/adm/context", json={"context":"restartctx"}, headers=headers, verify=ca)
+        mapped = json.loads(requests.post(tls_url + "/adm/token", json={}, headers=headers, verify=ca).text)
+        requests.post(tls_url + "/adm/token/grant", json={"token":mapped['token'], "grant":"GET", "context":"restartctx"}, headers=headers, verify=ca)
+        clientMap(directory, {"CN=mapped":mapped['id']})
+        time.sleep(1.5)
+
+        mutualTLS("MAPPED CERTIFICATE", requests.get(tls_url + "/con/restartctx/missing", verify=ca, cert=mapped_cert), 404)
+        mutualTLS("UNMAPPED CERTIFICATE", requests.get(tls_url + "/con/restartctx/missing", verify=ca, cert=unmapped_cert), 401)
+        mutualTLS("NO CERTIFICATE", requests.get(tls_url + "/con/restartctx/missing", verify=ca), 401)
+
+        clientMap(directory, {"CN=mapped":mapped['id'], "CN=unmapped":mapped['id']})
+        time.sleep(1.5)
+        mutualTLS("RELOADED MAP", requests.get(tls_url + "/con/restartctx/missing", verify=ca, cert=unmapped_cert), 404)
+
+        response = requests.post(tls_url + "/adm/token/rotate", json={"id":mapped['id']}, headers=headers, verify=ca)
+        print(
+            "----> ROTATED MAPPED TOKEN " + response.request.method + " " + response.request.path_url + " " + 
+            "STATUS_CODE:" + ("OK" if response.status_code == 201 else "NOK") + " " + 
+            "BODY:" + ("OK" if json.loads(response.text).get('tls_client_subjects') == ["CN=mapped", "CN=unmapped"] else "NOK")
+            )
+        stopServer(process)
+
+    print()
+
+if walkyria_bin:
+    # the last use of a token is listed with its metadata and kept over a restart of the memory store
+    print("TOKEN LAST USE")
+    def lastUsedAt(headers, token_id):
+        listed = json.loads(requests.get(restart_url + "/adm/token", headers=headers).text)['tokens']
+        return next(listed_token.get('last_used_at', "") for listed_token in listed if listed_token['id'] == token_id)
+
+    with tempfile.TemporaryDirectory() as directory:
+        process, adm_token = startServer(directory)
+        adm_headers = {
+            "Content-Type": "application/json",
+            "Authorization": f"bearer {adm_token}"
+        }
+        requests.post(restart_url + "/adm/context", json={"context":"restartctx"}, headers=adm_headers)
+        used = json.loads(requests.post(restart_url + "/adm/token", json={}, headers=adm_headers).text)
+        requests.post(restart_url + "/adm/token/grant", json={"token":used['token'], "grant":"GET", "context":"restartctx"}, headers=adm_headers)
+        unused_at = lastUsedAt(adm_headers, used['id'])
+        requests.get(restart_url + "/con/restartctx/missing", headers={"Authorization": f"bearer {used['token']}"})
+        used_at = lastUsedAt(adm_headers, used['id'])
+        stopServer(process)
+
+        process, adm_token = startServer(directory)
+        print(
+            "----> GET /adm/token " + 
+            "LAST_USED_AT:" + ("OK" if unused_at == "" and used_at != "" else "NOK") + " " + 
+            "RESTART:" + ("OK" if lastUsedAt(adm_headers, used['id']) == used_at else "NOK")
+            )
+        stopServer(process)
+
+    print()
+
+if walkyria_bin:
+    # reset-admin replaces the master admin token of a stopped server, and with -all-admins the delegated ones too
+    print("RESET ADMIN")
+    def resetAdmin(directory, *flags):
+        out = os.path.join(directory, "reset-token")
+        result = subprocess.run(
+            [walkyria_bin, "reset-admin", "-port", "53998", "-store", "memory", "-db", os.path.join(directory, "db.sqlite3"),
+             "-audit-file", "", "-out", out, *flags],
+            cwd=directory, capture_output=True, text=True)
+        with open(out) as file:
+            return result, file.read().strip()
+
+    def resetAdminStatus(name, adm_token, status_code):
+        response = requests.get(restart_url + "/adm/token", headers={"Authorization": f"bearer {adm_token}"})
+        return name + ":" + ("OK" if response.status_code == status_code else "NOK")
+
+    with tempfile.TemporaryDirectory() as directory:
+        process, old_adm_token = startServer(directory)
+        adm_headers = {
+            "Content-Type": "application/json",
+            "Authorization": f"bearer {old_adm_token}"
+        }
+        delegated_token = json.loads(requests.post(restart_url + "/adm/token", json={}, headers=adm_headers).text)['token']
+        requests.post(restart_url + "/adm/token/grant", json={"token":delegated_token, "grant":"ADM_TOKEN_GET", "context":"ALL"}, headers=adm_headers)
+        stopServer(process)
+
+        result, new_adm_token = resetAdmin(directory)
+        process, _ = startServer(directory)
+        print(
+            "----> reset-admin " + 
+            "EXIT_CODE:" + ("OK" if result.returncode == 0 else "NOK") + " " + 
+            "OUTPUT:" + ("OK" if "Removed 1 master admin tokens, kept 1 delegated admin tokens" in result.stdout else "NOK") + " " + 
+            resetAdminStatus("OLD_MASTER", old_adm_token, 401) + " " + 
+            resetAdminStatus("NEW_MASTER", new_adm_token, 200) + " " + 
+            resetAdminStatus("DELEGATED", delegated_token, 200)
+            )
+        stopServer(process)
+
+        result, all_adm_token = resetAdmin(directory, "-all-admins")
+        process, _ = startServer(directory)
+        print(
+            "----> reset-admin -all-admins " + 
+            "EXIT_CODE:" + ("OK" if result.returncode == 0 else "NOK") + " " + 
+            "OUTPUT:" + ("OK" if "Removed 2 admin tokens, master and delegated" in result.stdout else "NOK") + " " + 
+            resetAdminStatus("OLD_MASTER", new_adm_token, 401) + " " + 
+            resetAdminStatus("NEW_MASTER", all_adm_token, 200) + " " + 
+            resetAdminStatus("DELEGATED", delegated_token, 401)
+            )
+
+        result = subprocess.run(
+            [walkyria_bin, "reset-admin", "-port", "53998", "-store", "memory", "-db", os.path.join(directory, "db.sqlite3"), "-audit-file", ""],
+            cwd=directory, capture_output=True, text=True)
+        print(
+            "----> reset-admin RUNNING_SERVER " + 
+            "EXIT_CODE:" + ("OK" if result.returncode != 0 else "NOK") + " " + 
+            "OUTPUT:" + ("OK" if "stop it before resetting" in result.stdout + result.stderr else "NOK")
+            )
+        stopServer(process)
+
+    print()
+
+if walkyria_bin:
+    # the master admin token is created from a secret provided in WALKYRIA_ADMIN_TOKEN or in -admin-token-file
+    print("PROVIDED ADMIN TOKEN")
+    def providedAdmToken(name, adm_token, written):
+        response = requests.get(restart_url + "/adm/token", headers={"Authorization": f"bearer {adm_token}"})
+        print(
+            "----> " + name + " " + 
+            "STATUS_CODE:" + ("OK" if response.status_code == 200 else "NOK") + " " + 
+            "NOT_WRITTEN:" + ("OK" if written == "" else "NOK")
+            )
+
+    provided_token = str(uuid.uuid4())
+    with tempfile.TemporaryDirectory() as directory:
+        process, written = startServer(directory, env={"WALKYRIA_ADMIN_TOKEN": provided_token})
+        providedAdmToken("WALKYRIA_ADMIN_TOKEN", provided_token, written)
+        stopServer(process)
+
+    with tempfile.TemporaryDirectory() as directory:
+        secret_file = os.path.join(directory, "secret")
+        with open(secret_file, "w") as file:
+            file.write(provided_token + "\n")
+        process, written = startServer(directory, "-admin-token-file", secret_file)
+        providedAdmToken("-admin-token-file", provided_token, written)
+        stopServer(process)
+
+        for name, flags, env in [
+            ("SHORT_TOKEN", [], {"WALKYRIA_ADMIN_TOKEN": "short"}),
+            ("BOTH_PROVIDED", ["-admin-token-file", secret_file], {"WALKYRIA_ADMIN_TOKEN": provided_token})
+        ]:
+            result = subprocess.run(
+                [walkyria_bin, "-port", "53998", "-store", "memory", "-db", os.path.join(directory, "other.sqlite3"), "-audit-file", "", *flags],
+                cwd=directory, capture_output=True, text=True, timeout=10, env={**os.environ, **env})
+            print(
+                "----> " + name + " " + 
+                "EXIT_CODE:" + ("OK" if result.returncode != 0 else "NOK")
+                )
+
+    print()
+
+if walkyria_bin:
+    # concurrent writes share the connection pool of a SQLite database at a configured path without getting locked out
+    print("CONCURRENT SQLITE WRITES")
+    import threading
+
+    with tempfile.TemporaryDirectory() as directory:
+        db_path = os.path.join(directory, "data", "walkyria.sqlite3")
+        os.makedirs(os.path.dirname(db_path))
+        adm_token = str(uuid.uuid4())
+        process, _ = startServer(directory, "-store", "sqlite", "-db", db_path, "-db-max-conns", "4", env={"WALKYRIA_ADMIN_TOKEN": adm_token})
+        headers = restartSetup(adm_token)
+        statuses = {}
+        def concurrentWrite(key):
+            response = requests.post(restart_url + f"/con/restartctx/{key}", json={"value":key}, headers=headers)
+            statuses[key] = response.status_code
+        threads = [threading.Thread(target=concurrentWrite, args=(f"concurrent{index}",)) for index in range(40)]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join()
+        listed = json.loads(requests.get(restart_url + "/con/restartctx?prefix=concurrent&limit=100", headers=headers).text)
+        print(
+            "----> POST /con/restartctx " + 
+            "STATUS_CODES:" + ("OK" if len(statuses) == 40 and all(status == 201 for status in statuses.values()) else "NOK") + " " + 
+            "ENTRIES:" + ("OK" if len(listed['entries']) == 40 else "NOK") + " " + 
+            "DB_PATH:" + ("OK" if os.path.exists(db_path) else "NOK")
+            )
+        stopServer(process)
+
+    print()
+
+if walkyria_bin:
+    # the settings are layered, defaults then the configuration file then the environment then the flags,
+    # and the config subcommand reports every invalid one
+    print("CONFIGURATION LAYERS")
+    def runConfig(directory, *flags, env=None):
+        return subprocess.run([walkyria_bin, "config", *flags], cwd=directory, capture_output=True, text=True, timeout=10,
+            env={**{name: value for name, value in os.environ.items() if not name.startswith("WALKYRIA_")}, **(env or {})})
+
+    with tempfile.TemporaryDirectory() as directory:
+        config_file = os.path.join(directory, "walkyria.json")
+        with open(config_file, "w") as file:
+            json.dump({"port": 1111, "reap-batch": 10, "snapshot-interval": "5m"}, file)
+        result = runConfig(directory, "-config", config_file, "-port", "3333", env={"WALKYRIA_PORT": "2222", "WALKYRIA_REAP_BATCH": "20"})
+        effective = json.loads(result.stdout) if result.returncode == 0 else {}
+        print(
+            "----> config -config walkyria.json " + 
+            "EXIT_CODE:" + ("OK" if result.returncode == 0 else "NOK") + " " + 
+            "FLAG:" + ("OK" if effective.get('port') == 3333 else "NOK") + " " + 
+            "ENV:" + ("OK" if effective.get('reap-batch') == 20 else "NOK") + " " + 
+            "FILE:" + ("OK" if effective.get('snapshot-interval') == "5m0s" else "NOK") + " " + 
+            "DEFAULT:" + ("OK" if effective.get('store') == "sqlite" else "NOK")
+            )
+
+        result = runConfig(directory, env={"WALKYRIA_CONFIG": config_file})
+        effective = json.loads(result.stdout) if result.returncode == 0 else {}
+        print(
+            "----> config WALKYRIA_CONFIG " + 
+            "EXIT_CODE:" + ("OK" if result.returncode == 0 else "NOK") + " " + 
+            "FILE:" + ("OK" if effective.get('port') == 1111 else "NOK")
+            )
+
+        result = runConfig(directory, "-port", "0", "-store", "disk", "-reap-batch", "0")
+        print(
+            "----> config INVALID_SETTINGS " + 
+            "EXIT_CODE:" + ("OK" if result.returncode != 0 else "NOK") + " " + 
+            "ERRORS:" + ("OK" if all(error in result.stderr for error in ["port must be between", "unknown store disk", "reap-batch must be positive"]) else "NOK")
+            )
+
+        with open(config_file, "w") as file:
+            json.dump({"port": "none", "colour": "blue"}, file)
+        result = runConfig(directory, "-config", config_file)
+        print(
+            "----> config INVALID_FILE " + 
+            "EXIT_CODE:" + ("OK" if result.returncode != 0 else "NOK") + " " + 
+            "ERRORS:" + ("OK" if "unknown setting colour" in result.stderr and "invalid value \"none\" for port" in result.stderr else "NOK")
+            )
+
+        yaml_file = os.path.join(directory, "walkyria.yaml")
+        with open(yaml_file, "w") as file:
+            file.write("port: 1111\n")
+        result = runConfig(directory, "-config", yaml_file)
+        print(
+            "----> config walkyria.yaml " + 
+            "EXIT_CODE:" + ("OK" if result.returncode != 0 else "NOK") + " " + 
+            "ERRORS:" + ("OK" if "must be a JSON file named *.json" in result.stderr else "NOK")
+            )
+
+    print()
+
+if walkyria_bin:
+    # SIGTERM ends the watch streams, exits with 0 well before the shutdown timeout and keeps the memory store
+    print("GRACEFUL SHUTDOWN")
+    with tempfile.TemporaryDirectory() as directory:
+        process, adm_token = startServer(directory, "-shutdown-timeout", "20s")
+        headers = restartSetup(adm_token)
+        requests.post(restart_url + "/con/restartctx/before", json={"value":"kept"}, headers=headers)
+        response = requests.get(restart_url + "/con/restartctx/_watch", headers=headers, stream=True, timeout=30)
+        requests.post(restart_url + "/con/restartctx/watched", json={"value":"kept"}, headers=headers)
+
+        started = time.monotonic()
+        process.terminate()
+        lines = [line for line in response.iter_lines(decode_unicode=True) if line.startswith("event:")]
+        response.close()
+        exit_code = process.wait(timeout=30)
+        elapsed = time.monotonic() - started
+
+        process, _ = startServer(directory)
+        print(
+            "----> SIGTERM " + 
+            "STREAM_ENDED:" + ("OK" if "event: create" in lines else "NOK") + " " + 
+            "EXIT_CODE:" + ("OK" if exit_code == 0 else "NOK") + " " + 
+            "PROMPT:" + ("OK" if elapsed < 10 else "NOK")
+            )
+        restartEntries("RESTART AFTER SIGTERM", headers, {"before":"kept", "watched":"kept"})
+        stopServer(process)
+
+    print()
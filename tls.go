@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// How a client certificate is asked for once a client CA is set: optional
+// lets clients without one in, authenticated by their bearer token only,
+// require turns them away during the handshake.
+const (
+	tlsClientAuthOptional = "optional"
+	tlsClientAuthRequire  = "require"
+)
+
+// tlsFiles serves the certificate and key files of the server, the client CA
+// bundle and the map of client certificate subjects to token IDs, reloading
+// them when they change so certificates can be rotated without a restart.
+// The files are checked at most every interval, during a handshake.
+type tlsFiles struct {
+	certFile      string
+	keyFile       string
+	clientCAFile  string
+	clientMapFile string
+	clientAuth    tls.ClientAuthType
+	interval      time.Duration
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes []time.Time
+	config   *tls.Config
+	subjects map[string]string
+}
+
+// openTLSFiles loads the TLS files named by c.
+func openTLSFiles(c config) (*tlsFiles, error) {
+	t := &tlsFiles{
+		certFile:      c.tlsCert,
+		keyFile:       c.tlsKey,
+		clientCAFile:  c.tlsClientCA,
+		clientMapFile: c.tlsClientMap,
+		clientAuth:    tls.VerifyClientCertIfGiven,
+		interval:      c.tlsReloadInterval,
+	}
+	if c.tlsClientAuth == tlsClientAuthRequire {
+		t.clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	modTimes, err := t.modTimesOfFiles()
+	if err != nil {
+		return nil, err
+	}
+	err = t.load()
+	if err != nil {
+		return nil, err
+	}
+	t.modTimes = modTimes
+	t.checked = time.Now()
+	return t, nil
+}
+
+// load reads every file, replacing the served ones only when all of them are
+// valid.
+func (t *tlsFiles) load() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if t.clientCAFile != "" {
+		bundle, err := os.ReadFile(t.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return errors.New("no certificate found in " + t.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = t.clientAuth
+	}
+
+	subjects := map[string]string{}
+	if t.clientMapFile != "" {
+		data, err := os.ReadFile(t.clientMapFile)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &subjects)
+		if err != nil {
+			return errors.New("reading " + t.clientMapFile + ": " + err.Error())
+		}
+	}
+
+	t.config = config
+	t.subjects = subjects
+	return nil
+}
+
+func (t *tlsFiles) modTimesOfFiles() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, path := range []string{t.certFile, t.keyFile, t.clientCAFile, t.clientMapFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// reloadIfChanged reloads the files when one of them changed since they were
+// loaded, keeping the previous ones when they can't be, like in the middle of
+// a rotation.
+func (t *tlsFiles) reloadIfChanged() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.checked) < t.interval {
+		return
+	}
+	t.checked = time.Now()
+
+	modTimes, err := t.modTimesOfFiles()
+	if err != nil {
+		logStuff("error on checking the TLS files, keeping the loaded ones: " + err.Error())
+		return
+	}
+	if slices.EqualFunc(modTimes, t.modTimes, time.Time.Equal) {
+		return
+	}
+	err = t.load()
+	if err != nil {
+		logStuff("error on reloading the TLS files, keeping the loaded ones: " + err.Error())
+		return
+	}
+	t.modTimes = modTimes
+	logStuff("reloaded the TLS files")
+}
+
+// serverConfig returns the TLS configuration of the server, always handing
+// the latest files to a new connection.
+func (t *tlsFiles) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.reloadIfChanged()
+
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			return t.config, nil
+		},
+	}
+}
+
+// tokenID returns the ID of the token a client certificate subject is mapped
+// to, if any.
+func (t *tlsFiles) tokenID(subject string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tokenID, ok := t.subjects[subject]
+	return tokenID, ok
+}
+
+// subjectsOf returns the client certificate subjects mapped to a token ID,
+// sorted.
+func (t *tlsFiles) subjectsOf(tokenID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var subjects []string
+	for subject, id := range t.subjects {
+		if id == tokenID {
+			subjects = append(subjects, subject)
+		}
+	}
+	slices.Sort(subjects)
+	return subjects
+}
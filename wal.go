@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// walRecord is a single mutation stored in the write-ahead log. Tokens are
+// always logged as their SHA-256 hash, never as the secret.
+type walRecord struct {
+	Op         string      `json:"op"`
+	Context    string      `json:"context,omitempty"`
+	Key        string      `json:"key,omitempty"`
+	Value      string      `json:"value,omitempty"`
+	ExpiresAt  int64       `json:"expires_at,omitempty"`
+	Version    int64       `json:"version,omitempty"`
+	Token      string      `json:"token,omitempty"`
+	Permission string      `json:"permission,omitempty"`
+	KeyPrefix  string      `json:"key_prefix,omitempty"`
+	Segment    int         `json:"segment,omitempty"`
+	Records    []walRecord `json:"records,omitempty"`
+	// Metadata of a created token, ExpiresAt being its expiry time.
+	TokenID    string            `json:"token_id,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	CreatedAt  int64             `json:"created_at,omitempty"`
+	LastUsedAt int64             `json:"last_used_at,omitempty"`
+	Role       string            `json:"role,omitempty"`
+}
+
+// Operations recorded in the write-ahead log.
+const (
+	walCreateContext = "createContext"
+	walDeleteContext = "deleteContext"
+	walCreateEntry   = "createEntry"
+	walUpdateEntry   = "updateEntry"
+	walDeleteEntry   = "deleteEntry"
+	walCreateToken   = "createToken"
+	walDeleteToken   = "deleteToken"
+	walGrantToken    = "grantTokenPermission"
+	walRevokeToken   = "rovokeTokenPermission"
+	walSnapshot      = "snapshot"
+	walBatch         = "batch"
+	walUseToken      = "useToken"
+	walExpireToken   = "expireToken"
+	walCreateRole    = "createRole"
+	walDeleteRole    = "deleteRole"
+	walGrantRole     = "grantRolePermission"
+	walRevokeRole    = "revokeRolePermission"
+	walAssignRole    = "assignRole"
+	walUnassignRole  = "unassignRole"
+)
+
+// walHeaderSize is the size of the frame header: the payload length followed
+// by the CRC-32C checksum of the payload, both little endian.
+const walHeaderSize = 8
+
+var walCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// fsyncPolicy tells the write-ahead log when to fsync the file.
+// With always set every record is synced before it is acknowledged, with a
+// non zero interval the file is synced in the background at that pace, and
+// with neither the operating system decides when data reaches the disk.
+type fsyncPolicy struct {
+	always   bool
+	interval time.Duration
+}
+
+// parseFsyncPolicy parses "always", "never" or a duration such as "100ms".
+func parseFsyncPolicy(policy string) (fsyncPolicy, error) {
+	switch policy {
+	case "always":
+		return fsyncPolicy{always: true}, nil
+	case "never":
+		return fsyncPolicy{}, nil
+	}
+	interval, err := time.ParseDuration(policy)
+	if err != nil || interval <= 0 {
+		return fsyncPolicy{}, errors.New("invalid fsync policy " + policy + ", use always, never or a duration like 100ms")
+	}
+	return fsyncPolicy{interval: interval}, nil
+}
+
+// writeAheadLog is an append-only log of checksummed mutation records, split
+// in numbered segment files so old segments can be compacted away once a
+// snapshot covers them.
+type writeAheadLog struct {
+	mu      sync.Mutex
+	path    string
+	segment int
+	file    *os.File
+	policy  fsyncPolicy
+	dirty   bool
+	written bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// segmentPath returns the file name of a log segment.
+func segmentPath(path string, segment int) string {
+	return fmt.Sprintf("%s.%06d", path, segment)
+}
+
+// listSegments returns the numbers of the existing log segments, in order.
+func listSegments(path string) ([]int, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, match := range matches {
+		segment, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(match), filepath.Base(path)+"."))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// openWAL opens (or creates) a log segment for appending.
+func openWAL(path string, segment int, policy fsyncPolicy) (*writeAheadLog, error) {
+	file, err := os.OpenFile(segmentPath(path, segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	wal := &writeAheadLog{path: path, segment: segment, file: file, policy: policy}
+	if policy.interval > 0 {
+		wal.stop = make(chan struct{})
+		wal.done = make(chan struct{})
+		go wal.syncLoop()
+	}
+	return wal, nil
+}
+
+// append writes a record to the log. It returns once the record is handed to
+// the operating system, or once it is on disk with the always policy.
+func (wal *writeAheadLog) append(records ...walRecord) error {
+	var frames []byte
+	for _, record := range records {
+		var err error
+		frames, err = appendFrame(frames, record)
+		if err != nil {
+			return err
+		}
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if _, err := wal.file.Write(frames); err != nil {
+		return err
+	}
+	wal.written = true
+	if wal.policy.always {
+		return wal.file.Sync()
+	}
+	wal.dirty = true
+	return nil
+}
+
+// appendFrame encodes a record as a frame at the end of frames.
+func appendFrame(frames []byte, record walRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var header [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload, walCrcTable))
+	frames = append(frames, header[:]...)
+	return append(frames, payload...), nil
+}
+
+// rotate syncs and closes the current segment and starts appending to a new
+// one. It returns the number of the new segment; every record written after
+// the rotation lives in that segment or a later one.
+func (wal *writeAheadLog) rotate() (int, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	file, err := os.OpenFile(segmentPath(wal.path, wal.segment+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if err := wal.file.Sync(); err != nil {
+		file.Close()
+		return 0, err
+	}
+	wal.file.Close()
+
+	wal.file = file
+	wal.segment++
+	wal.dirty = false
+	wal.written = false
+	return wal.segment, nil
+}
+
+// hasWritten reports whether the current segment holds any record.
+func (wal *writeAheadLog) hasWritten() bool {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.written
+}
+
+// removeSegmentsBefore deletes the segments older than segment.
+func (wal *writeAheadLog) removeSegmentsBefore(segment int) error {
+	segments, err := listSegments(wal.path)
+	if err != nil {
+		return err
+	}
+	for _, old := range segments {
+		if old >= segment {
+			break
+		}
+		if err := os.Remove(segmentPath(wal.path, old)); err != nil {
+			return err
+		}
+		logStuff(fmt.Sprintf("compacted wal segment %d", old))
+	}
+	return nil
+}
+
+// syncLoop fsyncs the log periodically for the interval policy.
+func (wal *writeAheadLog) syncLoop() {
+	defer close(wal.done)
+	ticker := time.NewTicker(wal.policy.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wal.sync()
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+// sync flushes pending records to disk.
+func (wal *writeAheadLog) sync() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if !wal.dirty {
+		return nil
+	}
+	wal.dirty = false
+	return wal.file.Sync()
+}
+
+// close syncs and closes the log.
+func (wal *writeAheadLog) close() error {
+	if wal.stop != nil {
+		close(wal.stop)
+		<-wal.done
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if err := wal.file.Sync(); err != nil {
+		wal.file.Close()
+		return err
+	}
+	return wal.file.Close()
+}
+
+// replayWAL calls apply for every record of the log segment at path, in
+// order. A record torn by a crash while it was appended ends the latest
+// segment, last: the file is truncated right before it so new records are
+// appended after the last valid one. Anywhere else, a torn or corrupted
+// record is an error, the records after it would be lost.
+func replayWAL(path string, last bool, apply func(walRecord) error) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, count, err := readRecords(file, apply)
+	if errors.Is(err, errTornRecord) && last {
+		logStuff(fmt.Sprintf("replayed %d records of %s, truncating torn tail at offset %d", count, path, offset))
+		if err := file.Truncate(offset); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+	if errors.Is(err, errTornRecord) || errors.Is(err, errCorruptRecord) {
+		return fmt.Errorf("%s at offset %d of %s, after %d records", err, offset, path, count)
+	}
+	if err != nil {
+		return err
+	}
+
+	logStuff(fmt.Sprintf("replayed %d records of %s", count, path))
+	return nil
+}
+
+// errTornRecord is returned by readRecords when the last record of the file
+// is incomplete or does not match its checksum, and errCorruptRecord when a
+// record followed by others does not.
+var (
+	errTornRecord    = errors.New("torn wal record")
+	errCorruptRecord = errors.New("corrupted wal record")
+)
+
+// readRecords calls apply for every record of file. It returns the offset
+// right after the last valid record and the number of records read.
+func readRecords(file *os.File, apply func(walRecord) error) (int64, int, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	reader := bufio.NewReader(file)
+
+	var offset int64
+	var count int
+	for {
+		var header [walHeaderSize]byte
+		_, err := io.ReadFull(reader, header[:])
+		if err == io.EOF {
+			return offset, count, nil
+		}
+		if err != nil {
+			return offset, count, errTornRecord
+		}
+
+		length := int64(binary.LittleEndian.Uint32(header[0:4]))
+		if length > info.Size()-offset-walHeaderSize {
+			return offset, count, errTornRecord
+		}
+		// The record is complete, a mismatch is only a torn append when
+		// nothing follows it.
+		invalid := errCorruptRecord
+		if offset+walHeaderSize+length == info.Size() {
+			invalid = errTornRecord
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return offset, count, err
+		}
+		if crc32.Checksum(payload, walCrcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			return offset, count, invalid
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return offset, count, invalid
+		}
+		if err := apply(record); err != nil {
+			return offset, count, fmt.Errorf("replaying wal record %d: %w", count, err)
+		}
+		offset += walHeaderSize + length
+		count++
+	}
+}
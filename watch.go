@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of change events.
+const (
+	changeCreate = "create"
+	changeUpdate = "update"
+	changeDelete = "delete"
+	changeExpire = "expire"
+)
+
+// watchHistory is the number of past events kept so a watcher reconnecting
+// with the last event it saw misses nothing, and watchBuffer the number of
+// events a watcher can lag behind before its stream is closed.
+const (
+	watchHistory = 4096
+	watchBuffer  = 256
+)
+
+// changeEvent is a committed change to an entry. Value, Version and
+// ExpiresAt describe the entry as written, they are empty for a removal.
+type changeEvent struct {
+	ID        uint64
+	Op        string
+	Context   string
+	Key       string
+	Value     string
+	Version   int64
+	ExpiresAt int64
+}
+
+// errHistoryLost is returned when a watcher resumes from an event that is no
+// longer kept, it has to read the entries again before watching.
+var errHistoryLost = errors.New("event history lost, read the entries again before watching")
+
+// watcher receives the events of one context whose key starts with prefix.
+type watcher struct {
+	context string
+	prefix  string
+	events  chan changeEvent
+}
+
+func (w *watcher) matches(event changeEvent) bool {
+	return event.Context == w.context && strings.HasPrefix(event.Key, w.prefix)
+}
+
+// changeHub numbers the committed changes, keeps the latest of them and
+// fans them out to the watchers. The stores publish every change while still
+// holding their write lock, so the events are numbered in commit order.
+type changeHub struct {
+	mu       sync.Mutex
+	nextID   uint64
+	history  []changeEvent
+	watchers map[*watcher]struct{}
+}
+
+// newChangeHub starts numbering the events from the current time in
+// microseconds, so the IDs handed out by an earlier run are always older and
+// resuming from one of them is reported as lost history.
+func newChangeHub() *changeHub {
+	return &changeHub{
+		nextID:   uint64(time.Now().UnixMicro()),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// publish numbers the events and sends them to the matching watchers. A
+// watcher too far behind to take them is dropped: its channel is closed and
+// it can resume from the history. Publishing to a nil hub does nothing, like
+// for a store opened without watchers.
+func (h *changeHub) publish(events ...changeEvent) {
+	if h == nil || len(events) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, event := range events {
+		event.ID = h.nextID
+		h.nextID++
+
+		if len(h.history) == watchHistory {
+			h.history = append(h.history[:0], h.history[1:]...)
+		}
+		h.history = append(h.history, event)
+
+		for w := range h.watchers {
+			if !w.matches(event) {
+				continue
+			}
+			select {
+			case w.events <- event:
+			default:
+				h.dropLocked(w)
+			}
+		}
+	}
+}
+
+// batchEvents returns the events of the writes of a batch applied on context.
+func batchEvents(context string, results []batchResult) []changeEvent {
+	events := make([]changeEvent, 0, len(results))
+	for _, result := range results {
+		switch result.Op {
+		case batchCreate:
+			events = append(events, changeEvent{Op: changeCreate, Context: context, Key: result.Key, Value: result.Entry.Value, Version: result.Entry.Version, ExpiresAt: result.Entry.ExpiresAt})
+		case batchUpdate:
+			events = append(events, changeEvent{Op: changeUpdate, Context: context, Key: result.Key, Value: result.Entry.Value, Version: result.Entry.Version, ExpiresAt: result.Entry.ExpiresAt})
+		case batchDelete:
+			events = append(events, changeEvent{Op: changeDelete, Context: context, Key: result.Key})
+		}
+	}
+	return events
+}
+
+// expiryEvents returns the events of the expired entries reaped.
+func expiryEvents(reaped []entryRef) []changeEvent {
+	events := make([]changeEvent, 0, len(reaped))
+	for _, ref := range reaped {
+		events = append(events, changeEvent{Op: changeExpire, Context: ref.Context, Key: ref.Key})
+	}
+	return events
+}
+
+// subscribe registers a watcher of the keys of context starting with prefix.
+// When resuming, the events after lastID come back to be sent first.
+func (h *changeHub) subscribe(context string, prefix string, lastID uint64, resume bool) (*watcher, []changeEvent, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := &watcher{context: context, prefix: prefix, events: make(chan changeEvent, watchBuffer)}
+
+	var backlog []changeEvent
+	if resume {
+		oldest := h.nextID
+		if len(h.history) > 0 {
+			oldest = h.history[0].ID
+		}
+		if lastID >= h.nextID || lastID+1 < oldest {
+			return nil, nil, errHistoryLost
+		}
+		for _, event := range h.history {
+			if event.ID > lastID && w.matches(event) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	h.watchers[w] = struct{}{}
+	return w, backlog, nil
+}
+
+// unsubscribe removes a watcher, if it wasn't dropped already.
+func (h *changeHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.watchers[w]; ok {
+		h.dropLocked(w)
+	}
+}
+
+func (h *changeHub) dropLocked(w *watcher) {
+	delete(h.watchers, w)
+	close(w.events)
+}